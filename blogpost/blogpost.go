@@ -11,13 +11,38 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	StatusPublished = `published`
+	StatusDraft     = `draft`
+
+	KindPost = `post`
+	KindPage = `page`
+)
+
 type BlogPost struct {
 	Title   string
 	Date    time.Time
 	Content string
+	Summary string
+	Tags    []string
+	Status  string
+	Updated time.Time
+	Layout  string
+
+	//static pages carry their place in the site menu
+	Kind      string
+	MenuOrder int
+	MenuTitle string
+
+	//old names or paths that redirect to the post, RenamedFrom is only set
+	//on a push that renames an existing post
+	Aliases     []string
+	RenamedFrom string
 }
 
 type PostPush struct {
@@ -33,6 +58,9 @@ type PostContent struct {
 
 func DecodePostPush(nbpp *PostPush, seed int64, passbytes []byte) (PostContent, error) {
 	var nbpc PostContent
+	if len(nbpp.IV) != aes.BlockSize {
+		return nbpc, errors.New("Invalid IV length")
+	}
 	bb := bytes.NewBuffer(nbpp.Content)
 
 	//get hash generated
@@ -59,14 +87,42 @@ func DecodePostPush(nbpp *PostPush, seed int64, passbytes []byte) (PostContent,
 	return nbpc, nil
 }
 
+// hash covers the title, content and date exactly as the first version of
+// the protocol did, so posts that set nothing more still authenticate with
+// older clients.  Later fields are only hashed when they are set.
 func (bp BlogPost) hash() []byte {
 	hsh := sha256.New()
 	hsh.Write([]byte(bp.Title))
 	hsh.Write([]byte(bp.Content))
 	hsh.Write([]byte(bp.Date.Format(time.RFC3339Nano)))
+	hashField(hsh, "summary", bp.Summary)
+	hashField(hsh, "tags", bp.Tags...)
+	hashField(hsh, "status", bp.Status)
+	hashField(hsh, "layout", bp.Layout)
+	hashField(hsh, "kind", bp.Kind)
+	if bp.MenuOrder != 0 {
+		hashField(hsh, "menu_order", strconv.Itoa(bp.MenuOrder))
+	}
+	hashField(hsh, "menu_title", bp.MenuTitle)
+	hashField(hsh, "aliases", bp.Aliases...)
+	hashField(hsh, "renamed_from", bp.RenamedFrom)
 	return hsh.Sum(nil)
 }
 
+// hashField adds a named field to a post hash if it is set, every value is
+// length prefixed so neighbouring values can not run together
+func hashField(w io.Writer, name string, vals ...string) {
+	if len(vals) == 0 || (len(vals) == 1 && vals[0] == "") {
+		return
+	}
+	vals = append([]string{name}, vals...)
+	binary.Write(w, binary.LittleEndian, uint32(len(vals)))
+	for _, v := range vals {
+		binary.Write(w, binary.LittleEndian, uint32(len(v)))
+		io.WriteString(w, v)
+	}
+}
+
 func EncodeBlogPost(seed int64, passbytes []byte, bp BlogPost, name string) (*PostPush, error) {
 	//generate the crypto key
 	key := hashIt(seed, passbytes)
@@ -107,6 +163,45 @@ func EncodeBlogPost(seed int64, passbytes []byte, bp BlogPost, name string) (*Po
 	}, nil
 }
 
+// HasTag returns true if the post is tagged with tag, tags are case insensitive
+func (bp BlogPost) HasTag(tag string) bool {
+	for i := range bp.Tags {
+		if strings.EqualFold(bp.Tags[i], tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Published returns true if the post is publicly visible, posts without a
+// status predate the status field and are treated as published
+func (bp BlogPost) Published() bool {
+	return bp.Status == `` || bp.Status == StatusPublished
+}
+
+// IsPage returns true if the entry is a static page rather than a dated post,
+// entries without a kind predate static pages and are posts
+func (bp BlogPost) IsPage() bool {
+	return bp.Kind == KindPage
+}
+
+// MenuName returns the text used for the page in the site menu
+func (bp BlogPost) MenuName() string {
+	if bp.MenuTitle != `` {
+		return bp.MenuTitle
+	}
+	return bp.Title
+}
+
+// LastModified returns the time the post was last stored, falling back to
+// the post date for posts stored before updates were tracked
+func (bp BlogPost) LastModified() time.Time {
+	if bp.Updated.IsZero() {
+		return bp.Date
+	}
+	return bp.Updated
+}
+
 func CompareHash(a, b []byte) bool {
 	if len(a) != len(b) || len(a) == 0 || len(b) == 0 {
 		return false
@@ -3,6 +3,7 @@ package blogpost
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
@@ -152,3 +153,46 @@ func TestRead(t *testing.T) {
 		t.Fatal("Bad Content")
 	}
 }
+
+func TestHashCompat(t *testing.T) {
+	bp := BlogPost{
+		Title:   testTitle,
+		Content: testContent,
+		Date:    testDate,
+	}
+	//the hash of a post with only the original fields must not change
+	hsh := sha256.New()
+	hsh.Write([]byte(bp.Title))
+	hsh.Write([]byte(bp.Content))
+	hsh.Write([]byte(bp.Date.Format(time.RFC3339Nano)))
+	if !CompareHash(bp.hash(), hsh.Sum(nil)) {
+		t.Fatal("hash of a plain post changed")
+	}
+
+	a, b := bp, bp
+	a.Tags, b.Tags = []string{"ab", "c"}, []string{"a", "bc"}
+	if CompareHash(a.hash(), b.hash()) {
+		t.Fatal("tags run together in the hash")
+	}
+	a, b = bp, bp
+	a.Summary, b.Status = "draft", "draft"
+	if CompareHash(a.hash(), b.hash()) {
+		t.Fatal("fields run together in the hash")
+	}
+	a, b = bp, bp
+	a.MenuOrder = 1
+	if CompareHash(a.hash(), b.hash()) {
+		t.Fatal("menu order is not hashed")
+	}
+}
+
+func TestDecodeBadIV(t *testing.T) {
+	nbpp, err := genAndTestEncryptedNBPP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nbpp.IV = nbpp.IV[:4]
+	if _, err := DecodePostPush(nbpp, testSeed, testPassbytes); err == nil {
+		t.Fatal("short IV decoded")
+	}
+}
@@ -0,0 +1,32 @@
+package blogpost
+
+import (
+	"fmt"
+)
+
+// Codes the update endpoint answers a refused challenge or push with
+const (
+	UpdateExpiredChallenge = `expired_challenge`
+	UpdateAuthFailed       = `auth_failed`
+	UpdateInvalid          = `validation_failed`
+	UpdateNameConflict     = `name_conflict`
+	UpdateStorageFailed    = `storage_failed`
+	UpdateRateLimited      = `rate_limited`
+	UpdateLockedOut        = `locked_out`
+	UpdateNotAllowed       = `not_allowed`
+)
+
+// UpdateError is the JSON body of a refused challenge or push.  RetryAfter
+// is the number of seconds to wait before trying again when waiting helps.
+type UpdateError struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+func (ue *UpdateError) Error() string {
+	if ue.Message == "" {
+		return ue.Code
+	}
+	return fmt.Sprintf("%s: %s", ue.Code, ue.Message)
+}
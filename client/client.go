@@ -2,12 +2,16 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"flag"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/traetox/blogEngine/blogpost"
@@ -19,6 +23,23 @@ var (
 	templateFile = flag.String("f", "", "Template file")
 	name         = flag.String("n", "", "Name of new post")
 	title        = flag.String("t", "", "Title of new post")
+	tags         = flag.String("tags", "", "Comma separated list of tags for the new post")
+	summary      = flag.String("s", "", "Summary of new post used in feeds")
+	layout       = flag.String("layout", "", "Alternate layout to render the post with")
+	draft        = flag.Bool("draft", false, "Push the post as an unpublished draft")
+	page         = flag.Bool("page", false, "Push a static page instead of a dated post")
+	menuOrder    = flag.Int("menu-order", 0, "Position of a static page in the site menu, 0 leaves it out")
+	menuTitle    = flag.String("menu-title", "", "Menu text for a static page, defaults to the title")
+	aliases      = flag.String("aliases", "", "Comma separated list of old names or paths that redirect to the post")
+	renameFrom   = flag.String("rename-from", "", "Name of an existing post this push renames, the old name redirects to the new one")
+	caFile       = flag.String("ca", "", "PEM file of CA certificates to trust for an https server address")
+
+	client = http.DefaultClient
+)
+
+const (
+	//pushes tried before giving up on challenges that keep expiring
+	maxAttempts = 3
 )
 
 func init() {
@@ -38,15 +59,37 @@ func init() {
 	if *title == "" {
 		log.Fatal("Title required")
 	}
+	if !*page && (*menuOrder != 0 || *menuTitle != "") {
+		log.Fatal("Menu options only apply to static pages")
+	}
+	if *page && (*aliases != "" || *renameFrom != "") {
+		log.Fatal("Aliases and renames only apply to posts")
+	}
+	if *caFile != "" {
+		b, err := ioutil.ReadFile(*caFile)
+		if err != nil {
+			log.Fatal("Failed to read", *caFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			log.Fatal("No certificates found in", *caFile)
+		}
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client = &http.Client{Transport: tr}
+	}
 }
 
 func getSeed(addr string) (int64, error) {
 	var seed int64
-	res, err := http.Get(addr + "/update")
+	res, err := client.Get(addr + "/update")
 	if err != nil {
-		log.Fatal(err)
+		return -1, err
 	}
 	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return -1, readUpdateError(res)
+	}
 	if err := binary.Read(res.Body, binary.LittleEndian, &seed); err != nil {
 		return -1, err
 	}
@@ -58,17 +101,45 @@ func pushPost(addr string, seed int64, passbytes []byte, name string, bp blogpos
 	if err := blogpost.WriteBlogPost(bb, bp, name, seed, passbytes); err != nil {
 		return err
 	}
-	resp, err := http.Post(addr+"/update", "application/json", bb)
+	resp, err := client.Post(addr+"/update", "application/json", bb)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return errors.New("Bad status: " + resp.Status)
+		return readUpdateError(resp)
 	}
 	return nil
 }
 
+// push fetches a challenge and pushes the post with it, fetching a fresh
+// challenge when the server says the one used has expired
+func push(addr string, passbytes []byte, name string, bp blogpost.BlogPost) (err error) {
+	for i := 0; i < maxAttempts; i++ {
+		var seed int64
+		if seed, err = getSeed(addr); err != nil {
+			return err
+		}
+		err = pushPost(addr, seed, passbytes, name, bp)
+		var ue *blogpost.UpdateError
+		if !errors.As(err, &ue) || ue.Code != blogpost.UpdateExpiredChallenge || i == maxAttempts-1 {
+			return err
+		}
+		log.Println("Challenge expired, retrying")
+	}
+	return err
+}
+
+func splitTags(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
 func main() {
 	passbytes, err := ioutil.ReadFile(*passfile)
 	if err != nil {
@@ -79,21 +150,31 @@ func main() {
 		log.Fatal("Failed to read", *templateFile)
 	}
 
-	//go get the seed
-	seed, err := getSeed(*addr)
-	if err != nil {
-		log.Fatal("Failed to get seed from", *addr, err)
-	}
-
 	bp := blogpost.BlogPost{
 		Title:   *title,
 		Date:    time.Now(),
 		Content: string(templatebytes),
+		Summary: *summary,
+		Tags:    splitTags(*tags),
+		Aliases: splitTags(*aliases),
+		Status:  blogpost.StatusPublished,
+		Layout:  *layout,
+	}
+	if *draft {
+		bp.Status = blogpost.StatusDraft
+	}
+	bp.RenamedFrom = *renameFrom
+	if *page {
+		bp.Kind = blogpost.KindPage
+		bp.MenuOrder = *menuOrder
+		bp.MenuTitle = *menuTitle
 	}
 
-	//push the hash package
-	if err := pushPost(*addr, seed, passbytes, *name, bp); err != nil {
-		log.Fatal("Failed to push package", err)
+	//get a seed and push the hash package
+	if err := push(*addr, passbytes, *name, bp); err != nil {
+		msg, code := explain(err)
+		log.Println(msg)
+		os.Exit(code)
 	}
 	log.Println("New post pushed")
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+// exit codes, so scripts pushing posts can tell failures apart
+const (
+	exitFailure  = 1 //bad arguments or local files
+	exitNetwork  = 2 //the server could not be reached
+	exitAuth     = 3 //the server refused the password or address
+	exitInvalid  = 4 //the server refused the post itself
+	exitConflict = 5 //the name or an alias belongs to something else
+	exitServer   = 6 //the server failed to store the post
+	exitLimited  = 7 //too many attempts, try again later
+
+	//largest error body read from the server
+	maxErrorBody = 4096
+)
+
+// readUpdateError turns a refused request into the server's error, falling
+// back to the bare status for servers that send no JSON error
+func readUpdateError(resp *http.Response) error {
+	ue := &blogpost.UpdateError{}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if err != nil || json.Unmarshal(body, ue) != nil || ue.Code == "" {
+		return errors.New("Bad status: " + resp.Status)
+	}
+	return ue
+}
+
+// explain returns an actionable message and the exit code for a failed push
+func explain(err error) (string, int) {
+	var ue *blogpost.UpdateError
+	var ne *url.Error
+	switch {
+	case errors.As(err, &ue):
+	case errors.As(err, &ne):
+		return fmt.Sprintf("Could not reach %s, check the -a address and that the server is up: %v", *addr, ne.Err), exitNetwork
+	default:
+		return fmt.Sprintf("Failed to push package: %v", err), exitFailure
+	}
+	switch ue.Code {
+	case blogpost.UpdateAuthFailed:
+		return "The server rejected the push, check that -passfile is the server's password file", exitAuth
+	case blogpost.UpdateNotAllowed:
+		return "The server does not accept pushes from this address, add it to the server's update allowlist", exitAuth
+	case blogpost.UpdateExpiredChallenge:
+		return "The server kept expiring the challenge, check that nothing else is pushing from this address", exitAuth
+	case blogpost.UpdateInvalid:
+		return "The server refused the post: " + ue.Message, exitInvalid
+	case blogpost.UpdateNameConflict:
+		return "Name conflict: " + ue.Message + ", pick another -n or alias", exitConflict
+	case blogpost.UpdateStorageFailed:
+		return "The server failed to store the post, check its log: " + ue.Message, exitServer
+	case blogpost.UpdateRateLimited, blogpost.UpdateLockedOut:
+		return fmt.Sprintf("The server is refusing pushes for now, %s, try again in %d seconds", ue.Message, ue.RetryAfter), exitLimited
+	}
+	return "Failed to push package: " + ue.Error(), exitFailure
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+const (
+	apiPrefix         = `/api/v1/`
+	apiDefaultPerPage = 20
+	apiMaxPerPage     = 100
+	apiStatusAll      = `all`
+)
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiPost struct {
+	Name        string    `json:"name"`
+	Title       string    `json:"title"`
+	URL         string    `json:"url"`
+	Date        time.Time `json:"date"`
+	Updated     time.Time `json:"updated"`
+	Status      string    `json:"status"`
+	Tags        []string  `json:"tags"`
+	Summary     string    `json:"summary"`
+	ContentHTML string    `json:"content_html,omitempty"`
+}
+
+type apiPostList struct {
+	Page    int       `json:"page"`
+	PerPage int       `json:"per_page"`
+	Total   int       `json:"total"`
+	Posts   []apiPost `json:"posts"`
+}
+
+type apiTag struct {
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	Count int    `json:"count"`
+}
+
+// apiHandler serves the read only JSON API
+//
+//	GET /api/v1/posts?page=&per_page=&tag=&from=&to=&status=
+//	GET /api/v1/posts/<name>
+//	GET /api/v1/tags
+func (b *blog) apiHandler(w http.ResponseWriter, r *http.Request) {
+	apiCORS(w, r)
+	switch r.Method {
+	case "GET", "HEAD":
+	case "OPTIONS":
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		apiWriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	parts := strings.SplitN(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/", 2)
+	switch {
+	case parts[0] == "posts" && len(parts) == 1:
+		b.apiListPosts(w, r)
+	case parts[0] == "posts" && len(parts) == 2:
+		b.apiGetPost(w, r, parts[1])
+	case parts[0] == "tags" && len(parts) == 1:
+		b.apiListTags(w, r)
+	default:
+		apiWriteError(w, http.StatusNotFound, "unknown endpoint")
+	}
+}
+
+// apiCORS adds the CORS headers for requests from an allowed origin
+func apiCORS(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || *apiOrigins == "" {
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	for _, o := range strings.Split(*apiOrigins, ",") {
+		o = strings.TrimSpace(o)
+		if o == "*" || strings.EqualFold(o, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			return
+		}
+	}
+}
+
+func (b *blog) apiListPosts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	page, err := apiIntParam(q.Get("page"), 1)
+	if err != nil || page < 1 {
+		apiWriteError(w, http.StatusBadRequest, "invalid page")
+		return
+	}
+	perPage, err := apiIntParam(q.Get("per_page"), apiDefaultPerPage)
+	if err != nil || perPage < 1 || perPage > apiMaxPerPage {
+		apiWriteError(w, http.StatusBadRequest, "invalid per_page, must be between 1 and "+strconv.Itoa(apiMaxPerPage))
+		return
+	}
+	from, err := apiDateParam(q.Get("from"), false)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, "invalid from date")
+		return
+	}
+	to, err := apiDateParam(q.Get("to"), true)
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, "invalid to date")
+		return
+	}
+	status := q.Get("status")
+	switch status {
+	case "":
+		status = blogpost.StatusPublished
+	case blogpost.StatusPublished:
+	case blogpost.StatusDraft, apiStatusAll:
+		if !*apiDrafts {
+			apiWriteError(w, http.StatusForbidden, "drafts are not exposed by this server")
+			return
+		}
+	default:
+		apiWriteError(w, http.StatusBadRequest, "invalid status")
+		return
+	}
+	tag := q.Get("tag")
+
+	items, err := b.filterPosts(func(bp *blogpost.BlogPost) bool {
+		switch {
+		case status == blogpost.StatusPublished && !bp.Published():
+			return false
+		case status == blogpost.StatusDraft && bp.Published():
+			return false
+		case tag != "" && !bp.HasTag(tag):
+			return false
+		case !from.IsZero() && bp.Date.Before(from):
+			return false
+		case !to.IsZero() && !bp.Date.Before(to):
+			return false
+		}
+		return true
+	}, 0)
+	if err != nil {
+		apiWriteError(w, http.StatusInternalServerError, "failed to list posts")
+		return
+	}
+	resp := apiPostList{
+		Page:    page,
+		PerPage: perPage,
+		Total:   len(items),
+		Posts:   []apiPost{},
+	}
+	//pages past the end are empty, checked first so the offsets can not overflow
+	if page > len(items)/perPage+1 {
+		apiWriteJSON(w, http.StatusOK, resp)
+		return
+	}
+	base := b.siteBaseURL(r)
+	for i := (page - 1) * perPage; i < len(items) && i < page*perPage; i++ {
+		resp.Posts = append(resp.Posts, b.newAPIPost(base, items[i], false))
+	}
+	apiWriteJSON(w, http.StatusOK, resp)
+}
+
+func (b *blog) apiGetPost(w http.ResponseWriter, r *http.Request, name string) {
+	bp, err := b.db.Get(name)
+	if err != nil {
+		if err == errNotFound {
+			apiWriteError(w, http.StatusNotFound, "post not found")
+		} else {
+			apiWriteError(w, http.StatusInternalServerError, "failed to get post")
+		}
+		return
+	}
+	if !bp.Published() && !*apiDrafts {
+		apiWriteError(w, http.StatusNotFound, "post not found")
+		return
+	}
+	apiWriteJSON(w, http.StatusOK, b.newAPIPost(b.siteBaseURL(r), postItem{name: name, bp: bp}, true))
+}
+
+func (b *blog) apiListTags(w http.ResponseWriter, r *http.Request) {
+	items, err := b.publishedPosts("", 0)
+	if err != nil {
+		apiWriteError(w, http.StatusInternalServerError, "failed to list tags")
+		return
+	}
+	counts := map[string]int{}
+	for _, it := range items {
+		for _, t := range it.bp.Tags {
+			counts[strings.ToLower(t)]++
+		}
+	}
+	base := b.siteBaseURL(r)
+	tags := make([]apiTag, 0, len(counts))
+	for t, c := range counts {
+		tags = append(tags, apiTag{
+			Name:  t,
+			URL:   base + tagPath(t),
+			Count: c,
+		})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	apiWriteJSON(w, http.StatusOK, tags)
+}
+
+func (b *blog) newAPIPost(base string, it postItem, content bool) apiPost {
+	ap := apiPost{
+		Name:    it.name,
+		Title:   it.bp.Title,
+		URL:     base + b.postPath(it.name, it.bp.Date),
+		Date:    it.bp.Date,
+		Updated: it.bp.LastModified(),
+		Status:  it.bp.Status,
+		Tags:    it.bp.Tags,
+		Summary: postSummary(it.bp),
+	}
+	if ap.Status == "" {
+		ap.Status = blogpost.StatusPublished
+	}
+	if ap.Tags == nil {
+		ap.Tags = []string{}
+	}
+	if content {
+		ap.ContentHTML = string(sanitizeContent(it.bp.Content))
+	}
+	return ap
+}
+
+func apiIntParam(v string, def int) (int, error) {
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// apiDateParam accepts RFC3339 timestamps or plain dates, a plain date used
+// as the end of a range covers the whole day
+func apiDateParam(v string, end bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return t, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func apiWriteJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+func apiWriteError(w http.ResponseWriter, code int, msg string) {
+	apiWriteJSON(w, code, apiError{Error: msg})
+}
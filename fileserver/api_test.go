@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+func TestAPIListPaging(t *testing.T) {
+	b := testBlog(t)
+	for i, n := range []string{"a", "b", "c", "d", "e"} {
+		addTestPost(t, b, n, i, blogpost.BlogPost{})
+	}
+	for q, want := range map[string]int{
+		"":                                     5,
+		"?page=2&per_page=3":                   2,
+		"?page=3&per_page=3":                   0,
+		"?page=3074457345618258604&per_page=3": 0,
+		"?page=9223372036854775807&per_page=1": 0,
+	} {
+		rec := httptest.NewRecorder()
+		b.apiHandler(rec, httptest.NewRequest("GET", apiPrefix+"posts"+q, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%q: status %d", q, rec.Code)
+		}
+		var pl apiPostList
+		if err := json.Unmarshal(rec.Body.Bytes(), &pl); err != nil {
+			t.Fatal(err)
+		}
+		if len(pl.Posts) != want || pl.Total != 5 {
+			t.Fatalf("%q: got %d posts of %d, wanted %d", q, len(pl.Posts), pl.Total, want)
+		}
+	}
+}
+
+func TestAPIContentSanitized(t *testing.T) {
+	b := testBlog(t)
+	addTestPost(t, b, "x", 0, blogpost.BlogPost{Content: `<p onclick="evil()">hi</p><script>evil()</script>`})
+	rec := httptest.NewRecorder()
+	b.apiHandler(rec, httptest.NewRequest("GET", apiPrefix+"posts/x", nil))
+	var ap apiPost
+	if err := json.Unmarshal(rec.Body.Bytes(), &ap); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ap.ContentHTML, "hi") || strings.Contains(ap.ContentHTML, "evil") {
+		t.Fatalf("unsanitized content %q", ap.ContentHTML)
+	}
+}
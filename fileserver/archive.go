@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+type postItem struct {
+	name string
+	bp   *blogpost.BlogPost
+}
+
+// publishedPosts returns up to limit published posts newest first, optionally
+// restricted to a single tag.  A limit <= 0 returns every matching post.
+func (b *blog) publishedPosts(tag string, limit int) ([]postItem, error) {
+	return b.filterPosts(func(bp *blogpost.BlogPost) bool {
+		return bp.Published() && (tag == "" || bp.HasTag(tag))
+	}, limit)
+}
+
+// filterPosts returns up to limit posts newest first for which match returns
+// true.  A limit <= 0 returns every matching post.
+func (b *blog) filterPosts(match func(*blogpost.BlogPost) bool, limit int) ([]postItem, error) {
+	if b.db == nil {
+		return nil, errNilDB
+	}
+	pl, err := b.db.OrderedNameList()
+	if err != nil {
+		return nil, err
+	}
+	var items []postItem
+	for i := range pl {
+		if limit > 0 && len(items) >= limit {
+			break
+		}
+		bp, err := b.db.Get(pl[i].Name)
+		if err != nil {
+			if err == errNotFound {
+				continue
+			}
+			return nil, err
+		}
+		if !match(bp) {
+			continue
+		}
+		items = append(items, postItem{
+			name: pl[i].Name,
+			bp:   bp,
+		})
+	}
+	return items, nil
+}
+
+func (b *blog) archiveHandler(w http.ResponseWriter, r *http.Request) {
+	rc := NewResponseCapture(w)
+	r = b.withGeneration(r)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		rc.Header().Set("Allow", "GET, HEAD")
+		b.errorPage(rc, r, http.StatusMethodNotAllowed)
+	} else if b.serveFromCache(rc, r) {
+		//served straight from the rendered page cache
+	} else if err := b.getArchive(rc, r); err != nil {
+		b.serverError(rc, r, err)
+	}
+	//always log the request
+	b.logRequest(r, rc.Code())
+}
+
+// tagHandler serves the tag pages at /tag/<tag> and the per-tag feeds at
+// /tag/<tag>/<feed file>
+func (b *blog) tagHandler(w http.ResponseWriter, r *http.Request) {
+	rc := NewResponseCapture(w)
+	r = b.withGeneration(r)
+	parts := strings.Split(strings.Trim(path.Clean(r.URL.Path), "/"), "/")
+	switch len(parts) {
+	case 2:
+		if r.Method != "GET" && r.Method != "HEAD" {
+			rc.Header().Set("Allow", "GET, HEAD")
+			b.errorPage(rc, r, http.StatusMethodNotAllowed)
+		} else if r.URL.Path != "/tag/"+strings.ToLower(parts[1]) {
+			redirectCanonical(rc, r, tagPath(parts[1]))
+		} else if b.serveFromCache(rc, r) {
+			//served straight from the rendered page cache
+		} else if err := b.getTag(rc, r, parts[1]); err != nil {
+			b.serverError(rc, r, err)
+		}
+	case 3:
+		if ff, ok := feedFiles[parts[2]]; ok {
+			b.serveFeed(rc, r, ff, parts[1])
+		} else {
+			b.errorPage(rc, r, http.StatusNotFound)
+		}
+	default:
+		b.errorPage(rc, r, http.StatusNotFound)
+	}
+	//always log the request
+	b.logRequest(r, rc.Code())
+}
+
+func (b *blog) getArchive(rc *ResponseCapture, r *http.Request) error {
+	items, err := b.publishedPosts("", 0)
+	if err != nil {
+		return err
+	}
+	pd := b.newPageData(pageArchive, blogpost.BlogPost{
+		Title: "Archive",
+	})
+	pd.Canonical = "/archive"
+	b.setPosts(pd, items)
+	return b.servePage(rc, r, pd, b.listModTime(items))
+}
+
+func (b *blog) getTag(rc *ResponseCapture, r *http.Request, tag string) error {
+	items, err := b.publishedPosts(tag, 0)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		b.errorPage(rc, r, http.StatusNotFound)
+		return nil
+	}
+	pd := b.newPageData(pageTag, blogpost.BlogPost{
+		Title: "Posts tagged " + tag,
+	})
+	pd.Tag = tag
+	pd.TagURL = tagPath(tag)
+	pd.Canonical = pd.TagURL
+	b.setPosts(pd, items)
+	return b.servePage(rc, r, pd, b.listModTime(items))
+}
+
+// tagPath returns the site relative path of a tag page
+func tagPath(tag string) string {
+	return "/tag/" + url.PathEscape(strings.ToLower(tag))
+}
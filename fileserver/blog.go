@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	errDBOpen   = errors.New("DB already open")
+	errDBClosed = errors.New("DB already closed")
+)
+
+// blog is one site served by the process with its own post DB, templates,
+// webroot, update password and access log.  The default blog is configured
+// by the top level settings and serves every host no virtual host claims.
+// Templates and webroot files not found on disk come from the embedded
+// defaults.
+type blog struct {
+	*siteConfig
+	webroot    *layeredFS
+	theme      *layeredFS
+	site       *siteInfo
+	permalinks *permalink
+	db         *boltDB
+	docs       *docCache
+	templates  *templateCache
+	outLog     *os.File
+	limits     *updateLimiter
+	challenges *challenges
+	cspLog     *cspLimiter
+	passbytes  []byte
+}
+
+func newBlog(sc *siteConfig) (*blog, error) {
+	pl, err := parsePermalink(sc.permalink)
+	if err != nil {
+		return nil, err
+	}
+	si, err := sc.siteInfo()
+	if err != nil {
+		return nil, err
+	}
+	ul, err := newUpdateLimiter()
+	if err != nil {
+		return nil, err
+	}
+	return &blog{
+		siteConfig: sc,
+		webroot:    newLayeredFS(sc.root, defaultWebroot),
+		theme:      newLayeredFS(sc.templateDir, defaultTemplates),
+		site:       si,
+		permalinks: pl,
+		limits:     ul,
+		challenges: newChallenges(),
+		cspLog:     &cspLimiter{},
+	}, nil
+}
+
+// newBlogs creates a blog for every site, the default one first
+func newBlogs(scs []*siteConfig) ([]*blog, error) {
+	blogs := make([]*blog, 0, len(scs))
+	for _, sc := range scs {
+		b, err := newBlog(sc)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", sc, err)
+		}
+		blogs = append(blogs, b)
+	}
+	return blogs, nil
+}
+
+// openDB opens the post DB, retrying for up to wait while another process
+// holds it.  A restarted process has to wait for its parent to drain and
+// close the DB, new connections queue on the shared socket meanwhile.
+func (b *blog) openDB(wait time.Duration) error {
+	if b.db != nil {
+		return errDBOpen
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		db, err := NewBlogDB(b.postDB)
+		if err == nil {
+			b.db = db
+			b.docs = newDocCache(db)
+			db.OnChange(func(chg postChange) {
+				rendered.invalidate(b, chg)
+			})
+			return nil
+		}
+		if err != bolt.ErrTimeout || time.Now().After(deadline) {
+			return err
+		}
+	}
+}
+
+func (b *blog) closeDB() error {
+	if b.db == nil {
+		return errDBClosed
+	}
+	if err := b.db.Close(); err != nil {
+		return err
+	}
+	b.db = nil
+	return nil
+}
+
+// openLog opens the access log, commands run pages through the regular
+// handlers and discard their logging
+func (b *blog) openLog() (err error) {
+	if command != "" {
+		if b.outLog, err = os.OpenFile(os.DevNull, os.O_WRONLY, 0); err != nil {
+			return fmt.Errorf("opening %s\t%v", os.DevNull, err)
+		}
+		return nil
+	}
+	b.outLog, err = os.OpenFile(b.logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
+	if err != nil {
+		return fmt.Errorf("opening the log file %v\t%v", b.logFile, err)
+	}
+	if _, err = b.outLog.Seek(0, 2); err != nil {
+		return fmt.Errorf("seeking to end of log file\t%v", err)
+	}
+	return nil
+}
+
+func (b *blog) closeLog() error {
+	if b.outLog == nil {
+		return nil
+	}
+	return b.outLog.Close()
+}
+
+// loadPassword reads the password updates to this blog are encrypted with
+func (b *blog) loadPassword() error {
+	bts, err := ioutil.ReadFile(b.passFile)
+	if err != nil {
+		return err
+	}
+	b.passbytes = bts
+	return nil
+}
+
+func (b *blog) loadTemplates() error {
+	tc, err := newTemplateCache(b.theme, b)
+	if err != nil {
+		return err
+	}
+	b.templates = tc
+	return nil
+}
+
+// importRedirects adds the redirects in the configured file to the post DB
+func (b *blog) importRedirects() error {
+	if b.redirects == "" {
+		return nil
+	}
+	rds, err := loadRedirectFile(b.redirects)
+	if err != nil {
+		return err
+	}
+	return b.db.ImportRedirects(rds)
+}
+
+// hostMux hands each request to the blog serving its Host header, hosts no
+// blog claims go to the default blog
+type hostMux struct {
+	hosts map[string]http.Handler
+	def   http.Handler
+}
+
+func newHostMux(blogs []*blog) *hostMux {
+	hm := &hostMux{
+		hosts: make(map[string]http.Handler, len(blogs)),
+	}
+	for _, b := range blogs {
+		mux := b.newMux()
+		if len(b.hosts) == 0 {
+			hm.def = mux
+			continue
+		}
+		for _, h := range b.hosts {
+			hm.hosts[h] = mux
+		}
+	}
+	return hm
+}
+
+func (hm *hostMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h, ok := hm.hosts[requestHost(r)]; ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+	hm.def.ServeHTTP(w, r)
+}
+
+// requestHost returns the lower cased host a request was made to without
+// its port or a trailing dot
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
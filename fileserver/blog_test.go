@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+// testBlog returns the default blog with a fresh post DB and the default
+// sanitizer policy
+func testBlog(t *testing.T) *blog {
+	if err := SetSanitizePolicy(policyUGC); err != nil {
+		t.Fatal(err)
+	}
+	sc := defaultSite()
+	sc.postDB = filepath.Join(t.TempDir(), "posts.db")
+	b, err := newBlog(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.openDB(0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		b.closeDB()
+	})
+	return b
+}
+
+// addTestPost stores a published post dated days after a fixed day
+func addTestPost(t *testing.T, b *blog, name string, days int, bp blogpost.BlogPost) {
+	if bp.Title == "" {
+		bp.Title = name
+	}
+	bp.Date = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC).AddDate(0, 0, days)
+	bp.Status = blogpost.StatusPublished
+	if err := b.db.Add(name, &bp); err != nil {
+		t.Fatal(err)
+	}
+}
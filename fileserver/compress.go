@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	encBrotli = `br`
+	encGzip   = `gzip`
+
+	//responses smaller than this are not worth compressing
+	minCompressSize = 1024
+)
+
+var (
+	//codings we produce in order of preference
+	encodings = []string{encBrotli, encGzip}
+
+	sidecarExt = map[string]string{
+		encBrotli: ".br",
+		encGzip:   ".gz",
+	}
+	etagSuffix = map[string]string{
+		encBrotli: "-br",
+		encGzip:   "-gz",
+	}
+
+	compressibleTypes = []string{
+		"text/",
+		"application/json",
+		"application/javascript",
+		"application/xml",
+		"application/rss+xml",
+		"application/atom+xml",
+		"application/feed+json",
+		"image/svg+xml",
+	}
+)
+
+func compressible(contentType string) bool {
+	ct := strings.ToLower(contentType)
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(ct, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// preferredEncoding picks the coding the client rates highest out of those
+// offered, earlier offers win ties.  An empty string means identity.
+func preferredEncoding(r *http.Request, offered ...string) string {
+	q := map[string]float64{}
+	for _, ae := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(ae, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		if coding == "" {
+			continue
+		}
+		v := 1.0
+		for _, p := range parts[1:] {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+				if f, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					v = f
+				}
+			}
+		}
+		q[coding] = v
+	}
+	var best string
+	var bestQ float64
+	for _, o := range offered {
+		v, ok := q[o]
+		if !ok {
+			v, ok = q["*"]
+		}
+		if ok && v > bestQ {
+			best, bestQ = o, v
+		}
+	}
+	return best
+}
+
+func newEncoder(coding string, w io.Writer, best bool) (io.WriteCloser, error) {
+	switch coding {
+	case encBrotli:
+		if best {
+			return brotli.NewWriterLevel(w, brotli.BestCompression), nil
+		}
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression), nil
+	case encGzip:
+		if best {
+			return gzip.NewWriterLevel(w, gzip.BestCompression)
+		}
+		return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	}
+	return nil, fmt.Errorf("unknown content coding %q", coding)
+}
+
+// encodeBytes compresses b as tightly as the coding allows, for output that
+// is compressed once and served many times
+func encodeBytes(coding string, b []byte) ([]byte, error) {
+	bb := bytes.NewBuffer(nil)
+	enc, err := newEncoder(coding, bb, true)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := enc.Write(b); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return bb.Bytes(), nil
+}
+
+// compressHandler negotiates gzip or brotli compression for every response
+// with a compressible content type.  Responses a handler already encoded,
+// such as cached pages and static sidecar files, are passed through.  Each
+// coding gets its own strong ETag by suffixing the handler's, and the suffix
+// is stripped from If-None-Match again so handlers only ever see their own
+// validators.
+func compressHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &compressWriter{ResponseWriter: w, r: r}
+		if inm := r.Header.Get("If-None-Match"); inm != "" {
+			for coding, sfx := range etagSuffix {
+				//a tag for a coding the client no longer takes should not match
+				if strings.Contains(inm, sfx+`"`) && preferredEncoding(r, coding) != "" {
+					inm = strings.Replace(inm, sfx+`"`, `"`, -1)
+					cw.condCoding = coding
+				}
+			}
+			r = r.Clone(r.Context())
+			r.Header.Set("If-None-Match", inm)
+		}
+		defer cw.Close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	r          *http.Request
+	condCoding string
+	decided    bool
+	enc        io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if !cw.decided {
+		cw.decide(code, nil)
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		cw.decide(http.StatusOK, b)
+		cw.ResponseWriter.WriteHeader(http.StatusOK)
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressWriter) Close() error {
+	if cw.enc != nil {
+		return cw.enc.Close()
+	}
+	return nil
+}
+
+// decide picks the coding for the response once its headers are final
+func (cw *compressWriter) decide(code int, first []byte) {
+	cw.decided = true
+	h := cw.Header()
+	if code == http.StatusNotModified {
+		if cw.condCoding != "" {
+			setETagSuffix(h, cw.condCoding)
+		}
+		return
+	}
+	if code < http.StatusOK || code == http.StatusNoContent || code == http.StatusPartialContent {
+		return
+	}
+	ct := h.Get("Content-Type")
+	if ct == "" && first != nil {
+		ct = http.DetectContentType(first)
+		h.Set("Content-Type", ct)
+	}
+	if !compressible(ct) {
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	if ce := h.Get("Content-Encoding"); ce != "" {
+		if _, ok := etagSuffix[ce]; ok {
+			setETagSuffix(h, ce)
+		}
+		return
+	}
+	if cl, err := strconv.Atoi(h.Get("Content-Length")); err == nil && cl < minCompressSize {
+		return
+	}
+	coding := preferredEncoding(cw.r, encodings...)
+	if coding == "" {
+		return
+	}
+	enc, err := newEncoder(coding, cw.ResponseWriter, false)
+	if err != nil {
+		return
+	}
+	cw.enc = enc
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", coding)
+	setETagSuffix(h, coding)
+}
+
+func setETagSuffix(h http.Header, coding string) {
+	if etag := h.Get("ETag"); strings.HasSuffix(etag, `"`) {
+		h.Set("ETag", strings.TrimSuffix(etag, `"`)+etagSuffix[coding]+`"`)
+	}
+}
+
+// serveSidecar serves a precompressed .br or .gz copy of a static file if
+// the client accepts it and the copy is at least as new as the original.
+// It returns false if there is no usable sidecar.
+func serveSidecar(w http.ResponseWriter, r *http.Request, fsys fs.FS) bool {
+	name := path.Clean("/" + r.URL.Path)
+	orig := name[1:]
+	ofi, err := fs.Stat(fsys, orig)
+	//embedded files have no modification time to show a sidecar is current
+	if err != nil || ofi.IsDir() || ofi.ModTime().IsZero() || !compressible(mime.TypeByExtension(path.Ext(name))) {
+		return false
+	}
+	var offered []string
+	for _, coding := range encodings {
+		if sfi, err := fs.Stat(fsys, orig+sidecarExt[coding]); err == nil && !sfi.ModTime().Before(ofi.ModTime()) {
+			offered = append(offered, coding)
+		}
+	}
+	coding := preferredEncoding(r, offered...)
+	if coding == "" {
+		return false
+	}
+	fin, err := fsys.Open(orig + sidecarExt[coding])
+	if err != nil {
+		return false
+	}
+	defer fin.Close()
+	rs, ok := fin.(io.ReadSeeker)
+	if !ok {
+		return false
+	}
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(name)))
+	w.Header().Set("Content-Encoding", coding)
+	http.ServeContent(w, r, name, ofi.ModTime(), rs)
+	return true
+}
+
+// precompressStatic writes .br and .gz sidecars next to every compressible
+// file in the static directories that lacks an up to date one, returning how
+// many were written
+func precompressStatic(root string, dirs []string) (int, error) {
+	var n int
+	for _, d := range dirs {
+		err := filepath.Walk(filepath.Join(root, d), func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if fi.IsDir() || fi.Size() < minCompressSize || !compressible(mime.TypeByExtension(filepath.Ext(p))) {
+				return nil
+			}
+			var b []byte
+			for _, coding := range encodings {
+				sc := p + sidecarExt[coding]
+				if sfi, err := os.Stat(sc); err == nil && !sfi.ModTime().Before(fi.ModTime()) {
+					continue
+				}
+				if b == nil {
+					if b, err = ioutil.ReadFile(p); err != nil {
+						return err
+					}
+				}
+				cb, err := encodeBytes(coding, b)
+				if err != nil {
+					return err
+				}
+				//write aside and rename so a half written sidecar is never served
+				if err := ioutil.WriteFile(sc+".tmp", cb, 0644); err != nil {
+					return err
+				}
+				if err := os.Rename(sc+".tmp", sc); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
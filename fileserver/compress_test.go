@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestPreferredEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", encGzip},
+		{"br", encBrotli},
+		{"gzip, br", encBrotli},
+		{"gzip;q=1.0, br;q=0.5", encGzip},
+		{"br;q=0, gzip", encGzip},
+		{"BR, GZIP", encBrotli},
+		{"*", encBrotli},
+		{"*;q=0.1, br;q=0", encGzip},
+		{"br;q=0, gzip;q=0", ""},
+		{"identity, deflate", ""},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tc.accept)
+		if got := preferredEncoding(r, encodings...); got != tc.want {
+			t.Errorf("%q picked %q, wanted %q", tc.accept, got, tc.want)
+		}
+	}
+}
+
+// decodeBody undoes the content coding of a response
+func decodeBody(t *testing.T, coding string, b []byte) []byte {
+	var rdr io.Reader = bytes.NewReader(b)
+	switch coding {
+	case encBrotli:
+		rdr = brotli.NewReader(rdr)
+	case encGzip:
+		gr, err := gzip.NewReader(rdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rdr = gr
+	}
+	out, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestCompressHandler(t *testing.T) {
+	body := []byte(strings.Repeat("compress me ", 200))
+	h := compressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if r.Header.Get("If-None-Match") == `"abc"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.URL.Path == "/small" {
+			w.Header().Set("Content-Length", "5")
+			w.Write(body[:5])
+			return
+		}
+		w.Write(body)
+	}))
+
+	for _, tc := range []struct {
+		path   string
+		accept string
+		inm    string
+		code   int
+		coding string
+		etag   string
+	}{
+		{"/", "br, gzip", "", http.StatusOK, encBrotli, `"abc-br"`},
+		{"/", "gzip", "", http.StatusOK, encGzip, `"abc-gz"`},
+		{"/", "br;q=0, gzip;q=0.5", "", http.StatusOK, encGzip, `"abc-gz"`},
+		{"/", "", "", http.StatusOK, "", `"abc"`},
+		{"/small", "br", "", http.StatusOK, "", `"abc"`},
+		//validators are matched without their coding suffix
+		{"/", "br", `"abc-br"`, http.StatusNotModified, "", `"abc-br"`},
+		{"/", "gzip", `"abc-gz"`, http.StatusNotModified, "", `"abc-gz"`},
+		{"/", "", `"abc"`, http.StatusNotModified, "", `"abc"`},
+		//but not for a coding the client has stopped taking
+		{"/", "gzip", `"abc-br"`, http.StatusOK, encGzip, `"abc-gz"`},
+	} {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		r.Header.Set("Accept-Encoding", tc.accept)
+		if tc.inm != "" {
+			r.Header.Set("If-None-Match", tc.inm)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		res := rec.Result()
+		if res.StatusCode != tc.code || res.Header.Get("Content-Encoding") != tc.coding || res.Header.Get("ETag") != tc.etag {
+			t.Errorf("%s %q %q: got %d %q %s", tc.path, tc.accept, tc.inm, res.StatusCode, res.Header.Get("Content-Encoding"), res.Header.Get("ETag"))
+			continue
+		}
+		if tc.code == http.StatusOK && tc.path == "/" {
+			if got := decodeBody(t, tc.coding, rec.Body.Bytes()); !bytes.Equal(got, body) {
+				t.Errorf("%q: body did not survive the round trip", tc.accept)
+			}
+		}
+	}
+}
+
+func TestPrecompressStatic(t *testing.T) {
+	root := t.TempDir()
+	css := []byte(strings.Repeat("body { color: red; }\n", 100))
+	files := map[string][]byte{
+		"css/site.css":  css,
+		"css/tiny.css":  []byte("a{}"),
+		"pics/logo.png": bytes.Repeat([]byte{0x89}, 4096),
+	}
+	for name, b := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dirs := []string{"/css/", "/pics/", "/js/"}
+	if n, err := precompressStatic(root, dirs); err != nil || n != 2 {
+		t.Fatalf("wrote %d sidecars: %v", n, err)
+	}
+	for _, sc := range []string{"css/tiny.css.gz", "pics/logo.png.gz"} {
+		if _, err := os.Stat(filepath.Join(root, sc)); err == nil {
+			t.Errorf("%s written", sc)
+		}
+	}
+	//current sidecars are left alone, stale ones are rewritten
+	if n, _ := precompressStatic(root, dirs); n != 0 {
+		t.Fatalf("rewrote %d current sidecars", n)
+	}
+	earlier := time.Now().Add(-time.Hour)
+	for _, coding := range encodings {
+		if err := os.Chtimes(filepath.Join(root, "css/site.css"+sidecarExt[coding]), earlier, earlier); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _ := precompressStatic(root, dirs); n != 2 {
+		t.Fatalf("rewrote %d stale sidecars", n)
+	}
+
+	fsys := os.DirFS(root)
+	for _, coding := range encodings {
+		r := httptest.NewRequest("GET", "/css/site.css", nil)
+		r.Header.Set("Accept-Encoding", coding)
+		rec := httptest.NewRecorder()
+		if !serveSidecar(rec, r, fsys) {
+			t.Fatalf("%s sidecar not served", coding)
+		}
+		if ce := rec.Header().Get("Content-Encoding"); ce != coding {
+			t.Fatalf("%s sidecar served as %q", coding, ce)
+		}
+		if got := decodeBody(t, coding, rec.Body.Bytes()); !bytes.Equal(got, css) {
+			t.Fatalf("%s sidecar does not match the file", coding)
+		}
+	}
+	//an original newer than its sidecars is served as is
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(root, "css/site.css"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/css/site.css", nil)
+	r.Header.Set("Accept-Encoding", "br, gzip")
+	if serveSidecar(httptest.NewRecorder(), r, fsys) {
+		t.Fatal("stale sidecar served")
+	}
+}
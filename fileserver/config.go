@@ -0,0 +1,372 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+var (
+	//config file keys, section.key, and the flag each one sets
+	configKeys = map[string]string{
+		"server.addr":             "addr",
+		"server.port":             "port",
+		"server.log_file":         "log-file",
+		"server.read_timeout":     "read-timeout",
+		"server.write_timeout":    "write-timeout",
+		"server.idle_timeout":     "idle-timeout",
+		"server.shutdown_timeout": "shutdown-timeout",
+
+		"tls.cert":           "tls-cert",
+		"tls.key":            "tls-key",
+		"tls.port":           "tls-port",
+		"tls.https_redirect": "https-redirect",
+		"tls.hsts":           "hsts",
+		"tls.acme_domains":   "acme-domains",
+		"tls.acme_email":     "acme-email",
+		"tls.acme_directory": "acme-directory",
+		"tls.acme_ca":        "acme-ca",
+		"tls.acme_cache":     "acme-cache",
+
+		"paths.root":      "root",
+		"paths.templates": "templates",
+		"paths.postdb":    "postdb",
+		"paths.passfile":  "passfile",
+		"paths.robots":    "robots",
+		"paths.redirects": "redirects",
+
+		"site.base_url":    "base-url",
+		"site.title":       "site-title",
+		"site.description": "site-description",
+		"site.author":      "site-author",
+		"site.permalink":   "permalink",
+		"site.tagline":     "site-tagline",
+		"site.social":      "site-social",
+		"site.analytics":   "site-analytics",
+		"site.footer":      "site-footer",
+
+		"feeds.summary": "feed-summary",
+		"feeds.length":  "feed-length",
+
+		"cache.cache_control":        "cache-control",
+		"cache.static_cache_control": "static-cache-control",
+		"cache.page_cache":           "page-cache",
+		"cache.precompress":          "precompress",
+		"cache.template_poll":        "template-poll",
+
+		"update.allow":         "update-allow",
+		"update.rate":          "update-rate",
+		"update.burst":         "update-burst",
+		"update.lockout_after": "update-lockout-after",
+		"update.lockout":       "update-lockout",
+		"update.max_lockout":   "update-max-lockout",
+		"update.challenge_ttl": "update-challenge-ttl",
+
+		"security.sanitize_policy":  "sanitize-policy",
+		"security.api_cors_origins": "api-cors-origins",
+		"security.api_drafts":       "api-drafts",
+
+		"security.csp":                "csp",
+		"security.csp_report_only":    "csp-report-only",
+		"security.frame_ancestors":    "frame-ancestors",
+		"security.referrer_policy":    "referrer-policy",
+		"security.permissions_policy": "permissions-policy",
+	}
+
+	//sections named by a quoted string and how to name them
+	namedSections = map[string]string{
+		vhostSection: `a quoted host, e.g. [vhost."blog.example.com"]`,
+		routeSection: `a quoted path, e.g. [headers."/static/"]`,
+	}
+)
+
+// configValue is a single setting read from a config file.  Settings of a
+// named section, such as a virtual host, carry the section and its name and
+// the setting within it rather than a flag.
+type configValue struct {
+	key     string
+	flag    string
+	section string
+	name    string
+	setting string
+	value   string
+}
+
+// configErrors is every problem found while validating the configuration
+type configErrors []string
+
+func (ce configErrors) Error() string {
+	return strings.Join(ce, "\n")
+}
+
+// parseConfig reads a TOML config file.  Settings live in the [section]s of
+// configKeys, virtual hosts are configured in [vhost."host"] sections and the
+// security headers of a path prefix in [headers."/prefix"] sections.  Values
+// are turned into the form their flag takes on the command line.
+func parseConfig(rdr io.Reader, name string) ([]configValue, error) {
+	var tree map[string]interface{}
+	md, err := toml.NewDecoder(rdr).Decode(&tree)
+	if err != nil {
+		if pe, ok := err.(toml.ParseError); ok {
+			return nil, fmt.Errorf("%s:%d: %s", name, pe.Position.Line, pe.Message)
+		}
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	var vals []configValue
+	for _, k := range md.Keys() {
+		how, named := namedSections[k[0]]
+		if md.Type(k...) == "Hash" {
+			if named && len(k) > 2 {
+				return nil, fmt.Errorf("%s: %s sections are named by %s", name, k[0], how)
+			}
+			continue
+		}
+		cv := configValue{key: strings.Join(k, ".")}
+		switch {
+		case named && len(k) == 3:
+			cv.section, cv.name, cv.setting = k[0], k[1], k[2]
+			cv.key = fmt.Sprintf("%s.%q.%s", k[0], k[1], k[2])
+			if cv.section == vhostSection {
+				cv.name = strings.ToLower(cv.name)
+			}
+			if !namedSetting(cv.section, cv.setting) {
+				return nil, fmt.Errorf("%s: unknown setting %s", name, cv.key)
+			}
+		case named:
+			return nil, fmt.Errorf("%s: %s sections are named by %s", name, k[0], how)
+		default:
+			if cv.flag = configKeys[cv.key]; cv.flag == "" {
+				return nil, fmt.Errorf("%s: unknown setting %s", name, cv.key)
+			}
+		}
+		if cv.value, err = configString(lookupConfig(tree, k), md.Type(k...)); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", name, cv.key, err)
+		}
+		vals = append(vals, cv)
+	}
+	return vals, nil
+}
+
+// namedSetting reports whether a named section of kind takes setting
+func namedSetting(kind, setting string) (ok bool) {
+	switch kind {
+	case vhostSection:
+		_, ok = vhostKeys[setting]
+	case routeSection:
+		_, ok = routeKeys[setting]
+	}
+	return
+}
+
+// lookupConfig returns the decoded value of a key
+func lookupConfig(tree map[string]interface{}, k toml.Key) interface{} {
+	var v interface{} = tree
+	for _, part := range k {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[part]
+	}
+	return v
+}
+
+// configString turns a value into the form its flag takes on the command
+// line.  Arrays become comma separated lists, a comma inside an item is
+// passed on as %2C, which URLs treat the same.
+func configString(v interface{}, typ string) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, it := range v {
+			s, ok := it.(string)
+			if !ok {
+				return "", fmt.Errorf("array items must be strings")
+			}
+			items = append(items, strings.Replace(s, ",", "%2C", -1))
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("%s values are not supported, durations are strings such as \"10s\"", strings.ToLower(typ))
+}
+
+// applyConfigFile sets every flag the file configures that was not given on
+// the command line, so flags always override the file.  The settings of
+// named sections, which have no flags, are returned.
+func applyConfigFile(fs *flag.FlagSet, file string) ([]configValue, error) {
+	fin, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+	vals, err := parseConfig(fin, file)
+	if err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var named []configValue
+	for _, v := range vals {
+		if v.section != "" {
+			named = append(named, v)
+			continue
+		}
+		if set[v.flag] {
+			continue
+		}
+		if err := fs.Set(v.flag, v.value); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", file, v.key, err)
+		}
+	}
+	return named, nil
+}
+
+// validateConfig checks the settings for the command being run, returning
+// every problem found rather than just the first.  Settings with a setter
+// are checked by applying them.
+func validateConfig() error {
+	var ce configErrors
+	ce = append(ce, validateSites()...)
+	ce = append(ce, validateRouteHeaders()...)
+	ce = append(ce, validateUpdateLimits()...)
+	if err := SetSanitizePolicy(*sanitizePolicy); err != nil {
+		ce = append(ce, err.Error())
+	}
+	switch command {
+	case exportCmd:
+		if *exportDir == "" {
+			ce = append(ce, "I need an output directory to export to")
+		}
+		if *baseURL == "" {
+			ce = append(ce, "I need a base URL to export with")
+		}
+	case deletePageCmd:
+		if flag.NArg() == 0 {
+			ce = append(ce, "I need the name of a page to delete")
+		}
+	case "":
+		if *port <= 0 || *port >= 0xffff {
+			ce = append(ce, fmt.Sprintf("I need a usable port to serve on (0 > port > %d)", 0xffff))
+		}
+		ce = append(ce, validateTLS()...)
+	}
+	if *readTimeout <= 0 || *writeTimeout <= 0 || *idleTimeout <= 0 || *shutdownTimeout <= 0 {
+		ce = append(ce, "server timeouts must be positive")
+	}
+	if *tmplPoll < 0 {
+		ce = append(ce, "template poll interval can not be negative")
+	}
+	if *pageCacheMB < 0 {
+		ce = append(ce, "page cache size can not be negative")
+	}
+	if *feedLength <= 0 {
+		ce = append(ce, "feed length must be positive")
+	}
+	if len(ce) > 0 {
+		return ce
+	}
+	return nil
+}
+
+// validateTLS checks the TLS settings, certificates come either from files
+// or from ACME
+func validateTLS() []string {
+	var ce []string
+	if (*tlsCert == "") != (*tlsKey == "") {
+		ce = append(ce, "TLS needs both a certificate and a key file")
+	}
+	if *tlsCert != "" && *acmeDomains != "" {
+		ce = append(ce, "TLS certificates come from either files or ACME, not both")
+	}
+	if !tlsEnabled() {
+		return ce
+	}
+	if *tlsPort <= 0 || *tlsPort >= 0xffff || *tlsPort == *port {
+		ce = append(ce, fmt.Sprintf("I need a usable HTTPS port apart from the HTTP one (0 > port > %d)", 0xffff))
+	}
+	if *hstsMaxAge < 0 {
+		ce = append(ce, "HSTS max-age can not be negative")
+	}
+	if *acmeDomains != "" {
+		if *acmeCache == "" {
+			ce = append(ce, "I need an ACME cache directory")
+		}
+		if u, err := url.Parse(*acmeDirectory); err != nil || u.Scheme != "https" || u.Host == "" {
+			ce = append(ce, fmt.Sprintf("ACME directory %q must be an https URL", *acmeDirectory))
+		}
+		if *acmeCA != "" {
+			if _, err := os.Stat(*acmeCA); err != nil {
+				ce = append(ce, fmt.Sprintf("ACME CA file %s is not usable: %v", *acmeCA, err))
+			}
+		}
+	}
+	return ce
+}
+
+// checkConfig goes beyond validation for -check-config, loading the files
+// the server would load at startup without touching the post DB, which a
+// running server holds
+func checkConfig() error {
+	if command == "" && tlsEnabled() {
+		//load the certificate and CA files the way the server will
+		if _, _, err := setupTLS(http.NotFoundHandler()); err != nil {
+			return fmt.Errorf("TLS: %v", err)
+		}
+	}
+	blogs, err := newBlogs(siteConfigs())
+	if err != nil {
+		return err
+	}
+	for _, b := range blogs {
+		if err := b.check(); err != nil {
+			if b.name != "" {
+				err = fmt.Errorf("%v: %v", b, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// check loads the templates and redirects of a blog
+func (b *blog) check() error {
+	if command != checkHTMLCmd && command != deletePageCmd {
+		if err := b.loadTemplates(); err != nil {
+			return fmt.Errorf("templates: %v", err)
+		}
+	}
+	if b.redirects != "" {
+		if _, err := loadRedirectFile(b.redirects); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printConfigError reports each configuration problem on its own line
+func printConfigError(err error) {
+	if ce, ok := err.(configErrors); ok {
+		for _, e := range ce {
+			fmt.Printf("ERROR: %s\n", e)
+		}
+		return
+	}
+	fmt.Printf("ERROR: %v\n", err)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testConfig = `
+# a comment
+[server]
+port = 8_080
+read_timeout = "5s" # trailing comment
+
+[site]
+title = "Hash # Blog"
+author = 'C:\Users\me'
+social = ["Search=https://example.com/?q=a,b"]
+
+[security]
+api_cors_origins = [
+	"https://a.example", # first
+	"https://b.example",
+]
+api_drafts = true
+
+[update]
+rate = 0.5
+allow = ["192.0.2.0/24"]
+`
+)
+
+func TestParseConfig(t *testing.T) {
+	vals, err := parseConfig(strings.NewReader(testConfig), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"port":             "8080",
+		"read-timeout":     "5s",
+		"site-title":       "Hash # Blog",
+		"site-author":      `C:\Users\me`,
+		"api-cors-origins": "https://a.example,https://b.example",
+		"api-drafts":       "true",
+		"site-social":      "Search=https://example.com/?q=a%2Cb",
+		"update-rate":      "0.5",
+		"update-allow":     "192.0.2.0/24",
+	}
+	if len(vals) != len(want) {
+		t.Fatalf("got %d values, wanted %d", len(vals), len(want))
+	}
+	for _, v := range vals {
+		if want[v.flag] != v.value {
+			t.Fatalf("%s = %q, wanted %q", v.key, v.value, want[v.flag])
+		}
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	bad := map[string]string{
+		"unknown setting server.prot":              "[server]\nprot = 80",
+		"test:2: expected value":                   "[site]\ntitle = Blog",
+		"test:3: Key 'site.title' has already":     "[site]\ntitle = \"a\"\ntitle = \"b\"",
+		"test:2: expected '.' or ']'":              "[site\ntitle = \"a\"",
+		"test:2: unexpected EOF":                   "[site]\ntitle",
+		"array items must be":                      "[security]\napi_cors_origins = [1, 2]",
+		"test:2: unexpected EOF; expected '\"'":    "[site]\ntitle = \"a",
+		"quoted host":                              "[vhost.blog.example.com]\npostdb = \"a\"",
+		"named by a quoted host":                   "[vhost]\npostdb = \"a\"",
+		`unknown setting vhost."a.example".port`:   "[vhost.\"a.example\"]\nport = 80",
+		"quoted path":                              "[headers.static.files]\ncsp = \"a\"",
+		`unknown setting headers."/files/".postdb`: "[headers.\"/files/\"]\npostdb = \"a\"",
+		"server.port: datetime values":             "[server]\nport = 1979-05-27T07:32:00Z",
+	}
+	for msg, cfg := range bad {
+		if _, err := parseConfig(strings.NewReader(cfg), "test"); err == nil {
+			t.Fatalf("no error for %q", cfg)
+		} else if !strings.Contains(err.Error(), msg) {
+			t.Fatalf("error %q for %q does not mention %q", err, cfg, msg)
+		}
+	}
+}
+
+func TestApplyConfigFlagsOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "blog.toml")
+	cfg := "[server]\nport = 8080\naddr = \"127.0.0.1\"\nread_timeout = \"5s\"\n"
+	if err := ioutil.WriteFile(file, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	p := fs.Int("port", 80, "")
+	a := fs.String("addr", "", "")
+	rt := fs.Duration("read-timeout", time.Second, "")
+	if err := fs.Parse([]string{"-port", "9090"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyConfigFile(fs, file); err != nil {
+		t.Fatal(err)
+	}
+	if *p != 9090 || *a != "127.0.0.1" || *rt != 5*time.Second {
+		t.Fatalf("bad settings port %d addr %q read timeout %v", *p, *a, *rt)
+	}
+
+	//values are checked by the flag they set
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Duration("read-timeout", time.Second, "")
+	if err := ioutil.WriteFile(file, []byte("[server]\nread_timeout = \"soon\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyConfigFile(fs, file); err == nil || !strings.Contains(err.Error(), "blog.toml: server.read_timeout") {
+		t.Fatalf("bad duration not reported with its key: %v", err)
+	}
+}
+
+func TestVhosts(t *testing.T) {
+	cfg := `
+[paths]
+root = "/srv/blog"
+
+[vhost."A.example"]
+aliases = ["www.a.example"]
+postdb = "/srv/a.db"
+
+[vhost."b.example"]
+postdb = "/srv/b.db"
+root = "/srv/b"
+`
+	vals, err := parseConfig(strings.NewReader(cfg), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vvals []configValue
+	for _, v := range vals {
+		if v.section != "" {
+			vvals = append(vvals, v)
+		}
+	}
+	oldRoot, oldDB := *root, *postDB
+	defer func() {
+		*root, *postDB = oldRoot, oldDB
+	}()
+	*root, *postDB = "/srv/blog", "/srv/blog.db"
+	scs := newVhosts(vvals)
+	if len(scs) != 2 {
+		t.Fatalf("got %d vhosts, wanted 2", len(scs))
+	}
+	a, b := scs[0], scs[1]
+	if a.name != "a.example" || strings.Join(a.hosts, ",") != "a.example,www.a.example" {
+		t.Fatalf("bad vhost %s hosts %v", a.name, a.hosts)
+	}
+	//unset settings come from the default site, apart from the post DB
+	//and the password and log files
+	if a.root != "/srv/blog" || a.postDB != "/srv/a.db" || b.root != "/srv/b" {
+		t.Fatalf("bad vhost settings %+v %+v", a, b)
+	}
+	ce := strings.Join(a.validate(), "\n")
+	for _, msg := range []string{"password file", "log file"} {
+		if !strings.Contains(ce, msg) {
+			t.Fatalf("vhost without its own %s validated: %q", msg, ce)
+		}
+	}
+
+	hm := &hostMux{
+		hosts: map[string]http.Handler{},
+		def:   namedHandler(""),
+	}
+	for _, sc := range scs {
+		for _, h := range sc.hosts {
+			hm.hosts[h] = namedHandler(sc.name)
+		}
+	}
+	for host, want := range map[string]string{
+		"A.example:8080":   "a.example",
+		"www.a.example.":   "a.example",
+		"b.example":        "b.example",
+		"other.example":    "",
+		"":                 "",
+		"[::1]:80":         "",
+		"b.example.evil.x": "",
+	} {
+		w := httptest.NewRecorder()
+		hm.ServeHTTP(w, &http.Request{Host: host})
+		if w.Body.String() != want {
+			t.Fatalf("host %q routed to %q, wanted %q", host, w.Body.String(), want)
+		}
+	}
+}
+
+func namedHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	})
+}
+
+func TestValidateConfig(t *testing.T) {
+	oldRoot, oldDB, oldFeed := *root, *postDB, *feedLength
+	defer func() {
+		*root, *postDB, *feedLength = oldRoot, oldDB, oldFeed
+	}()
+	*root = "/nonexistent/root"
+	*postDB = ""
+	*feedLength = 0
+	err := validateConfig()
+	ce, ok := err.(configErrors)
+	if !ok {
+		t.Fatalf("expected configErrors, got %v", err)
+	}
+	for _, msg := range []string{"root /nonexistent/root", "post DB", "feed length"} {
+		if !strings.Contains(ce.Error(), msg) {
+			t.Fatalf("%q missing from %q", msg, ce.Error())
+		}
+	}
+}
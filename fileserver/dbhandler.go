@@ -27,7 +27,21 @@ type boltDB struct {
 	mtx            *sync.Mutex
 	db             *bolt.DB
 	cache          map[string]*blogpost.BlogPost
+	pages          map[string]*blogpost.BlogPost
 	postListCached []PostTS
+	gen            uint64
+	modTime        time.Time
+	watchers       []func(postChange)
+}
+
+// postChange describes a change to the stored posts, the names touched and
+// every tag they carried before or after the change.  Page changes alter the
+// site menu and so touch everything.
+type postChange struct {
+	Names []string
+	Tags  []string
+	Page  bool
+	Gen   uint64
 }
 
 type PostTS struct {
@@ -41,8 +55,14 @@ func NewBlogDB(dbFile string) (*boltDB, error) {
 		return nil, err
 	}
 	if err := bdb.Update(func(tx *bolt.Tx) error {
-		if _, lerr := tx.CreateBucketIfNotExists(dbId); lerr != nil {
-			return lerr
+		newPages := tx.Bucket(pagesBkt) == nil
+		for _, id := range [][]byte{dbId, pagesBkt, redirectsBkt, searchIndexBkt, searchDocsBkt} {
+			if _, lerr := tx.CreateBucketIfNotExists(id); lerr != nil {
+				return lerr
+			}
+		}
+		if newPages {
+			return migratePages(tx)
 		}
 		return nil
 	}); err != nil {
@@ -53,11 +73,27 @@ func NewBlogDB(dbFile string) (*boltDB, error) {
 		mtx:   &sync.Mutex{},
 		db:    bdb,
 		cache: make(map[string]*blogpost.BlogPost, 1),
+		pages: make(map[string]*blogpost.BlogPost, 1),
 	}
 	if err := db.nlInitCache(); err != nil {
 		db.Close()
 		return nil, err
 	}
+	if err := db.nlInitPages(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := db.invalidatePostListCache(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := db.nlEnsureIndex(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if len(db.postListCached) > 0 {
+		db.modTime = db.postListCached[0].Date
+	}
 	return db, nil
 }
 
@@ -72,6 +108,7 @@ func (db *boltDB) Close() error {
 	}
 	db.db = nil
 	db.cache = nil
+	db.pages = nil
 	return nil
 }
 
@@ -101,10 +138,33 @@ func (db *boltDB) Add(name string, bp *blogpost.BlogPost) error {
 	if db.db == nil {
 		return errNotOpen
 	}
+	bp.Updated = time.Now()
+	pc := postChange{Names: []string{name}, Tags: bp.Tags}
+	if obp, ok := db.cache[name]; ok {
+		pc.Tags = append(pc.Tags, obp.Tags...)
+	}
+	//a rename keeps the original date and leaves the old name as an alias
+	renamed := bp.RenamedFrom
+	bp.RenamedFrom = ""
+	if renamed == name {
+		renamed = ""
+	} else if renamed != "" {
+		if obp, ok := db.cache[renamed]; ok {
+			bp.Date = obp.Date
+			bp.Aliases = append(bp.Aliases, obp.Aliases...)
+			pc.Tags = append(pc.Tags, obp.Tags...)
+		}
+		pc.Names = append(pc.Names, renamed)
+		bp.Aliases = append(bp.Aliases, renamed)
+	}
+	bp.Aliases = uniqueAliases(bp.Aliases)
 	//add into the bolt DB
-	if err := db.dbAdd(name, bp); err != nil {
+	if err := db.dbAdd(name, bp, renamed); err != nil {
 		return err
 	}
+	if renamed != "" {
+		delete(db.cache, renamed)
+	}
 	//add into the cache
 	cbp, ok := db.cache[name]
 	if ok {
@@ -112,6 +172,7 @@ func (db *boltDB) Add(name string, bp *blogpost.BlogPost) error {
 	} else {
 		db.cache[name] = bp
 	}
+	db.nlChanged(pc)
 	return db.invalidatePostListCache()
 }
 
@@ -142,14 +203,19 @@ func (db *boltDB) Delete(name string) error {
 	if db.db == nil {
 		return errNotOpen
 	}
+	pc := postChange{Names: []string{name}}
+	if obp, ok := db.cache[name]; ok {
+		pc.Tags = obp.Tags
+	}
 	delete(db.cache, name)
 	if err := db.dbDelete(name); err != nil {
 		return err
 	}
+	db.nlChanged(pc)
 	return db.invalidatePostListCache()
 }
 
-func (db *boltDB) dbAdd(name string, bp *blogpost.BlogPost) error {
+func (db *boltDB) dbAdd(name string, bp *blogpost.BlogPost, renamed string) error {
 	return db.db.Update(func(tx *bolt.Tx) error {
 		bb := bytes.NewBuffer(nil)
 		genc := gob.NewEncoder(bb)
@@ -157,7 +223,24 @@ func (db *boltDB) dbAdd(name string, bp *blogpost.BlogPost) error {
 			return err
 		}
 		bkt := tx.Bucket(dbId)
-		return bkt.Put([]byte(name), bb.Bytes())
+		if err := bkt.Put([]byte(name), bb.Bytes()); err != nil {
+			return err
+		}
+		if err := indexPost(tx, name, bp); err != nil {
+			return err
+		}
+		if renamed != "" {
+			if err := bkt.Delete([]byte(renamed)); err != nil {
+				return err
+			}
+			if err := unindexPost(tx, renamed); err != nil {
+				return err
+			}
+			if err := syncAliases(tx, renamed, nil); err != nil {
+				return err
+			}
+		}
+		return syncAliases(tx, name, bp.Aliases)
 	})
 }
 
@@ -184,13 +267,24 @@ func (db *boltDB) dbGet(name string) (*blogpost.BlogPost, error) {
 
 func (db *boltDB) dbDelete(name string) error {
 	if err := db.db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(dbId).Delete([]byte(name))
+		return deletePost(tx, name)
 	}); err != nil {
 		return err
 	}
 	return nil
 }
 
+// deletePost removes a post along with its search terms and aliases
+func deletePost(tx *bolt.Tx, name string) error {
+	if err := tx.Bucket(dbId).Delete([]byte(name)); err != nil {
+		return err
+	}
+	if err := unindexPost(tx, name); err != nil {
+		return err
+	}
+	return syncAliases(tx, name, nil)
+}
+
 func (db *boltDB) OrderedNameList() ([]PostTS, error) {
 	var pl []PostTS
 	db.mtx.Lock()
@@ -198,10 +292,39 @@ func (db *boltDB) OrderedNameList() ([]PostTS, error) {
 	if db.db == nil {
 		return pl, errNotOpen
 	}
+	pl = make([]PostTS, len(db.postListCached))
 	copy(pl, db.postListCached)
 	return pl, nil
 }
 
+// Generation returns a counter that is bumped on every change to the post set
+// along with the time of the last change.  Consumers that derive output from
+// the post list can compare generations to decide if they need to regenerate.
+func (db *boltDB) Generation() (uint64, time.Time) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	return db.gen, db.modTime
+}
+
+// OnChange registers fn to be told about every change to the stored posts.
+// It is called with the DB locked, so it must not call back into the DB.
+func (db *boltDB) OnChange(fn func(postChange)) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	db.watchers = append(db.watchers, fn)
+}
+
+func (db *boltDB) nlChanged(pc postChange) {
+	db.gen++
+	db.modTime = time.Now()
+	pc.Gen = db.gen
+	for _, fn := range db.watchers {
+		fn(pc)
+	}
+}
+
+// LatestPost returns the newest published post, the post list is kept
+// newest first
 func (db *boltDB) LatestPost() (blogpost.BlogPost, error) {
 	var lp blogpost.BlogPost
 	db.mtx.Lock()
@@ -209,14 +332,16 @@ func (db *boltDB) LatestPost() (blogpost.BlogPost, error) {
 	if db.db == nil {
 		return lp, errNotOpen
 	}
-	if len(db.postListCached) <= 0 {
-		return lp, errNoPosts
-	}
-	bp, ok := db.cache[db.postListCached[0].Name]
-	if !ok {
-		return lp, errors.New("Cache invalid")
+	for i := range db.postListCached {
+		bp, ok := db.cache[db.postListCached[i].Name]
+		if !ok {
+			return lp, errors.New("Cache invalid")
+		}
+		if bp.Published() {
+			return *bp, nil
+		}
 	}
-	return *bp, nil
+	return lp, errNoPosts
 }
 
 func (db *boltDB) invalidatePostListCache() error {
@@ -235,4 +360,4 @@ type postList []PostTS
 
 func (pl postList) Len() int           { return len(pl) }
 func (pl postList) Swap(i, j int)      { pl[i], pl[j] = pl[j], pl[i] }
-func (pl postList) Less(i, j int) bool { return pl[i].Date.Before(pl[j].Date) }
+func (pl postList) Less(i, j int) bool { return pl[i].Date.After(pl[j].Date) }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type cachedDoc struct {
+	gen     uint64
+	modTime time.Time
+	etag    string
+	buff    []byte
+}
+
+// docCache holds documents derived from the post list such as feeds and the
+// sitemap.  Entries are regenerated only when the post DB generation moves
+// past the one they were rendered from, and storing an entry drops those of
+// older generations.
+type docCache struct {
+	mtx     sync.Mutex
+	db      *boltDB
+	entries map[string]*cachedDoc
+}
+
+func newDocCache(db *boltDB) *docCache {
+	return &docCache{
+		db:      db,
+		entries: make(map[string]*cachedDoc, 1),
+	}
+}
+
+// get returns the document stored under key, rendering it if it is missing
+// or stale.  Documents with an empty key are rendered every time.
+func (dc *docCache) get(key string, render func(modTime time.Time) ([]byte, error)) (*cachedDoc, error) {
+	if dc == nil || dc.db == nil {
+		return nil, errNilDB
+	}
+	gen, modTime := dc.db.Generation()
+
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+	if cd, ok := dc.entries[key]; ok && cd.gen == gen {
+		return cd, nil
+	}
+	buff, err := render(modTime)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(buff)
+	cd := &cachedDoc{
+		gen:     gen,
+		modTime: modTime,
+		etag:    `"` + hex.EncodeToString(sum[:16]) + `"`,
+		buff:    buff,
+	}
+	if key == "" {
+		return cd, nil
+	}
+	for k, old := range dc.entries {
+		if old.gen != gen {
+			delete(dc.entries, k)
+		}
+	}
+	dc.entries[key] = cd
+	return cd, nil
+}
+
+// docKey returns the cache key for a document.  Without a configured base
+// URL documents carry the request's Host, which the client picks, so they
+// are not cached at all.
+func (b *blog) docKey(parts ...string) string {
+	if b.baseURL == "" {
+		return ""
+	}
+	return strings.Join(parts, "|")
+}
+
+// serveDoc writes a cached document, ServeContent handles the conditional
+// request headers using the ETag and modification time
+func serveDoc(w http.ResponseWriter, r *http.Request, cd *cachedDoc, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", cd.etag)
+	if *cacheControl != "" {
+		w.Header().Set("Cache-Control", *cacheControl)
+	}
+	http.ServeContent(w, r, "", cd.modTime, bytes.NewReader(cd.buff))
+}
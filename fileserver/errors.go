@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+var (
+	errorMessages = map[int]string{
+		http.StatusNotFound:            "There is nothing to see here. No, really, I couldn't find anything.",
+		http.StatusForbidden:           "You are not allowed to look at this.",
+		http.StatusMethodNotAllowed:    "That is not something you can do to this page.",
+		http.StatusGone:                "This page has been removed and is not coming back.",
+		http.StatusInternalServerError: "Something broke while putting this page together.",
+	}
+)
+
+// errorPage renders the error page template for code with the standard
+// layout.  If the template itself fails a bare page is written so the status
+// code always makes it out.
+func (b *blog) errorPage(w http.ResponseWriter, r *http.Request, code int) {
+	b.renderError(w, r, code, "")
+}
+
+// serverError logs err under a fresh request ID and renders a 500 page
+// showing that ID so a report can be matched to the log
+func (b *blog) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	id := newRequestID()
+	fmt.Printf("ERROR request %s: %v\n", id, err)
+	w.Header().Set("X-Request-ID", id)
+	b.renderError(w, r, http.StatusInternalServerError, id)
+}
+
+func (b *blog) renderError(w http.ResponseWriter, r *http.Request, code int, reqID string) {
+	msg, ok := errorMessages[code]
+	if !ok {
+		msg = http.StatusText(code)
+	}
+	pd := b.newPageData(pageError, blogpost.BlogPost{
+		Title: http.StatusText(code),
+	})
+	pd.Code = code
+	pd.Message = msg
+	pd.RequestID = reqID
+
+	bb := bytes.NewBuffer(nil)
+	if err := b.renderTemplate(bb, pd); err != nil {
+		fmt.Printf("Failed to render %d error page: %v\n", code, err)
+		bb.Reset()
+		fmt.Fprintf(bb, "<h1>Error %d</h1>\n<h4>%s</h4>\n", code, msg)
+		if reqID != "" {
+			fmt.Fprintf(bb, "<p>Request ID %s</p>\n", reqID)
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(withRequestNonce(r, bb.Bytes()))
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// staticFileServer serves a static directory of the webroot, refusing
+// directory listings and replacing the file server's plain text errors with
+// the error pages
+func (b *blog) staticFileServer(dir string) http.Handler {
+	sub := mustSub(b.webroot, strings.Trim(dir, "/"))
+	fs := http.FileServer(http.FS(sub))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			b.errorPage(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path == "" || r.URL.Path[len(r.URL.Path)-1] == '/' {
+			b.errorPage(w, r, http.StatusForbidden)
+			return
+		}
+		if *staticCache != "" {
+			w.Header().Set("Cache-Control", *staticCache)
+		}
+		if serveSidecar(w, r, sub) {
+			return
+		}
+		fs.ServeHTTP(&errorInterceptor{ResponseWriter: w, b: b, r: r}, r)
+	})
+}
+
+// errorInterceptor swaps any error response for the rendered error page and
+// discards the body the wrapped handler writes with it
+type errorInterceptor struct {
+	http.ResponseWriter
+	b      *blog
+	r      *http.Request
+	failed bool
+}
+
+func (ei *errorInterceptor) WriteHeader(code int) {
+	if code >= 400 {
+		ei.failed = true
+		ei.ResponseWriter.Header().Del("Content-Type")
+		ei.ResponseWriter.Header().Del("X-Content-Type-Options")
+		ei.b.errorPage(ei.ResponseWriter, ei.r, code)
+		return
+	}
+	ei.ResponseWriter.WriteHeader(code)
+}
+
+func (ei *errorInterceptor) Write(b []byte) (int, error) {
+	if ei.failed {
+		return len(b), nil
+	}
+	return ei.ResponseWriter.Write(b)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorPages(t *testing.T) {
+	b := testBlog(t)
+	//a theme directory only needs the error page to override it
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, pageDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	editTemplate(t, dir, "pages/error.template", `{{define "content"}}custom {{.Code}}: {{.Message}}{{if .RequestID}} id {{.RequestID}}{{end}}{{end}}`, time.Now())
+	b.theme = newLayeredFS(dir, defaultTemplates)
+	if err := b.loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		h    http.Handler
+		meth string
+		path string
+		code int
+	}{
+		{http.HandlerFunc(b.templateHandler), "GET", "/nope", http.StatusNotFound},
+		{http.HandlerFunc(b.archiveHandler), "POST", "/archive", http.StatusMethodNotAllowed},
+		{http.StripPrefix("/css/", b.staticFileServer("/css/")), "GET", "/css/nope.css", http.StatusNotFound},
+		{http.StripPrefix("/css/", b.staticFileServer("/css/")), "GET", "/css/", http.StatusForbidden},
+	} {
+		rec := httptest.NewRecorder()
+		tc.h.ServeHTTP(rec, httptest.NewRequest(tc.meth, tc.path, nil))
+		body := rec.Body.String()
+		want := fmt.Sprintf("custom %d: %s", tc.code, template.HTMLEscapeString(errorMessages[tc.code]))
+		if rec.Code != tc.code || !strings.Contains(body, want) {
+			t.Errorf("%s %s: %d %q", tc.meth, tc.path, rec.Code, body)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+			t.Errorf("%s %s: served as %q", tc.meth, tc.path, ct)
+		}
+	}
+
+	//server errors show the request ID they were logged under
+	rec := httptest.NewRecorder()
+	b.serverError(rec, httptest.NewRequest("GET", "/", nil), errors.New("broken"))
+	id := rec.Header().Get("X-Request-ID")
+	if rec.Code != http.StatusInternalServerError || id == "" || !strings.Contains(rec.Body.String(), "custom 500: ") ||
+		!strings.Contains(rec.Body.String(), " id "+id) {
+		t.Fatalf("server error page %d %q", rec.Code, rec.Body.String())
+	}
+
+	//without templates a bare page still carries the status
+	b.templates = nil
+	rec = httptest.NewRecorder()
+	b.errorPage(rec, httptest.NewRequest("GET", "/", nil), http.StatusGone)
+	if rec.Code != http.StatusGone || !strings.Contains(rec.Body.String(), "<h1>Error 410</h1>") {
+		t.Fatalf("bare error page %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// exportWriter collects a response so exported pages go through exactly the
+// same handlers and templates as served pages
+type exportWriter struct {
+	hdr  http.Header
+	code int
+	bb   bytes.Buffer
+}
+
+func newExportWriter() *exportWriter {
+	return &exportWriter{
+		hdr:  make(http.Header),
+		code: http.StatusOK,
+	}
+}
+
+func (ew *exportWriter) Header() http.Header         { return ew.hdr }
+func (ew *exportWriter) Write(b []byte) (int, error) { return ew.bb.Write(b) }
+func (ew *exportWriter) WriteHeader(c int)           { ew.code = c }
+
+// runExport renders every page, feed and the sitemap into out and copies the
+// static asset directories alongside them.  Pages are written as
+// <route>/index.html so the original URLs keep working on a static host.
+func (b *blog) runExport(out string) error {
+	if err := b.openDB(0); err != nil {
+		return err
+	}
+	defer b.closeDB()
+	if err := b.loadTemplates(); err != nil {
+		return err
+	}
+	routes, err := b.exportRoutes()
+	if err != nil {
+		return err
+	}
+	mux := b.newMux()
+	for _, rt := range routes {
+		req, err := http.NewRequest("GET", rt, nil)
+		if err != nil {
+			return err
+		}
+		ew := newExportWriter()
+		mux.ServeHTTP(ew, req)
+		if ew.code != http.StatusOK {
+			return fmt.Errorf("%s returned %d", rt, ew.code)
+		}
+		if err := writeExportFile(exportFilePath(out, rt), ew.bb.Bytes()); err != nil {
+			return err
+		}
+	}
+	for _, d := range staticDirs {
+		if err := copyTree(b.webroot, strings.Trim(d, "/"), filepath.Join(out, d)); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Exported %d pages to %s\n", len(routes), out)
+	return nil
+}
+
+// exportRoutes lists every URL that makes up the static site
+func (b *blog) exportRoutes() ([]string, error) {
+	routes := []string{"/", "/archive", "/sitemap.xml", "/robots.txt"}
+	for ff := range feedFiles {
+		routes = append(routes, "/"+ff)
+	}
+	items, err := b.publishedPosts("", 0)
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]bool{}
+	for _, it := range items {
+		routes = append(routes, b.postPath(it.name, it.bp.Date))
+		for _, t := range it.bp.Tags {
+			tags[strings.ToLower(t)] = true
+		}
+	}
+	for t := range tags {
+		routes = append(routes, tagPath(t))
+		for ff := range feedFiles {
+			routes = append(routes, tagPath(t)+"/"+ff)
+		}
+	}
+	pages, err := b.db.PageNames()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pages {
+		routes = append(routes, pagePath(p))
+	}
+	return routes, nil
+}
+
+func exportFilePath(out, route string) string {
+	p := path.Clean(route)
+	if path.Ext(p) == "" {
+		p = path.Join(p, "index.html")
+	}
+	return filepath.Join(out, filepath.FromSlash(p))
+}
+
+func writeExportFile(p string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, b, 0644)
+}
+
+// copyTree copies the regular files under src in fsys into dst, a missing
+// src is not an error as not every site has every asset directory
+func copyTree(fsys fs.FS, src, dst string) error {
+	if _, err := fs.Stat(fsys, src); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return fs.WalkDir(fsys, src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, src), "/")
+		target := filepath.Join(dst, filepath.FromSlash(rel))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return copyFile(fsys, p, target)
+	})
+}
+
+func copyFile(fsys fs.FS, src, dst string) error {
+	fin, err := fsys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+	fout, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fout, fin); err != nil {
+		fout.Close()
+		return err
+	}
+	return fout.Close()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+func TestExportFilePath(t *testing.T) {
+	out := filepath.FromSlash("/out")
+	for route, want := range map[string]string{
+		"/":                  "/out/index.html",
+		"/archive":           "/out/archive/index.html",
+		"/2020/01/hello/":    "/out/2020/01/hello/index.html",
+		"/feed.xml":          "/out/feed.xml",
+		"/tag/go/feed.json":  "/out/tag/go/feed.json",
+		"/../../etc/passwd/": "/out/etc/passwd/index.html",
+	} {
+		if got := exportFilePath(out, route); got != filepath.FromSlash(want) {
+			t.Errorf("%s exported to %s, wanted %s", route, got, want)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	b := testBlog(t)
+	if b.permalinks, _ = parsePermalink("/:year/:month/:slug/"); b.permalinks == nil {
+		t.Fatal("bad permalink")
+	}
+	addTestPost(t, b, "hello", 0, blogpost.BlogPost{Tags: []string{"Go"}, Content: "<p>hello world</p>"})
+	if err := b.db.Add("draft", &blogpost.BlogPost{Title: "Draft", Status: blogpost.StatusDraft}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.db.AddPage("about", &blogpost.BlogPost{Title: "About", Kind: blogpost.KindPage}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := b.exportRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(routes)
+	want := []string{
+		"/", "/2020/01/hello/", "/about", "/archive", "/atom.xml", "/feed.json", "/feed.xml",
+		"/robots.txt", "/sitemap.xml", "/tag/go", "/tag/go/atom.xml", "/tag/go/feed.json", "/tag/go/feed.xml",
+	}
+	if strings.Join(routes, " ") != strings.Join(want, " ") {
+		t.Fatalf("exporting\n%q\nwanted\n%q", routes, want)
+	}
+
+	//runExport opens the DB itself
+	if err := b.closeDB(); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	if err := b.runExport(out); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{
+		"index.html", "2020/01/hello/index.html", "about/index.html", "archive/index.html",
+		"feed.xml", "tag/go/index.html", "tag/go/atom.xml", "sitemap.xml", "robots.txt",
+		"css/bootstrap.css", "js/jquery.js",
+	} {
+		if fi, err := os.Stat(filepath.Join(out, filepath.FromSlash(f))); err != nil || fi.Size() == 0 {
+			t.Errorf("%s not exported: %v", f, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out, "draft")); err == nil {
+		t.Error("draft exported")
+	}
+	page, err := ioutil.ReadFile(filepath.Join(out, "2020", "01", "hello", "index.html"))
+	if err != nil || !strings.Contains(string(page), "hello world") {
+		t.Fatalf("post page missing its content: %v", err)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+const (
+	feedRSS feedFormat = iota
+	feedAtom
+	feedJSON
+
+	summaryLength = 300
+)
+
+var (
+	feedFiles = map[string]feedFormat{
+		"feed.xml":  feedRSS,
+		"atom.xml":  feedAtom,
+		"feed.json": feedJSON,
+	}
+
+	errUnknownFeed = errors.New("unknown feed format")
+)
+
+type feedFormat int
+
+func (ff feedFormat) String() string {
+	switch ff {
+	case feedRSS:
+		return "feed.xml"
+	case feedAtom:
+		return "atom.xml"
+	case feedJSON:
+		return "feed.json"
+	}
+	return "unknown"
+}
+
+func (ff feedFormat) ContentType() string {
+	switch ff {
+	case feedRSS:
+		return "application/rss+xml; charset=utf-8"
+	case feedAtom:
+		return "application/atom+xml; charset=utf-8"
+	case feedJSON:
+		return "application/feed+json; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+func (b *blog) feedHandler(ff feedFormat) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.serveFeed(w, r, ff, "")
+	})
+}
+
+func (b *blog) serveFeed(w http.ResponseWriter, r *http.Request, ff feedFormat, tag string) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		b.errorPage(w, r, http.StatusMethodNotAllowed)
+		return
+	}
+	base := b.siteBaseURL(r)
+	cd, err := b.docs.get(b.docKey(ff.String(), strings.ToLower(tag)), func(modTime time.Time) ([]byte, error) {
+		items, err := b.publishedPosts(tag, *feedLength)
+		if err != nil {
+			return nil, err
+		}
+		//like tag pages, feeds of tags no post carries do not exist
+		if tag != "" && len(items) == 0 {
+			return nil, errNoPosts
+		}
+		return b.renderFeed(ff, items, tag, base, modTime)
+	})
+	if err == errNoPosts {
+		b.errorPage(w, r, http.StatusNotFound)
+		return
+	} else if err != nil {
+		b.serverError(w, r, err)
+		return
+	}
+	serveDoc(w, r, cd, ff.ContentType())
+}
+
+func (b *blog) renderFeed(ff feedFormat, items []postItem, tag, base string, modTime time.Time) ([]byte, error) {
+	title := b.site.Name
+	self := base + "/" + ff.String()
+	if tag != "" {
+		title += " - " + tag
+		self = base + tagPath(tag) + "/" + ff.String()
+	}
+	switch ff {
+	case feedRSS:
+		return b.renderRSS(items, title, base, self, modTime)
+	case feedAtom:
+		return b.renderAtom(items, title, base, self, modTime)
+	case feedJSON:
+		return b.renderJSONFeed(items, title, base, self)
+	}
+	return nil, errUnknownFeed
+}
+
+type rssDoc struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	AtomLink      rssLink   `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Categories  []string `xml:"category"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+func (b *blog) renderRSS(items []postItem, title, base, self string, modTime time.Time) ([]byte, error) {
+	doc := rssDoc{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:       title,
+			Link:        base + "/",
+			Description: b.site.Description,
+			AtomLink: rssLink{
+				Href: self,
+				Rel:  "self",
+				Type: feedRSS.ContentType(),
+			},
+		},
+	}
+	if !modTime.IsZero() {
+		doc.Channel.LastBuildDate = modTime.UTC().Format(time.RFC1123Z)
+	}
+	for _, it := range items {
+		link := base + b.postPath(it.name, it.bp.Date)
+		doc.Channel.Items = append(doc.Channel.Items, rssItem{
+			Title:       it.bp.Title,
+			Link:        link,
+			Description: feedContent(it.bp),
+			GUID:        rssGUID{IsPermaLink: true, Value: link},
+			PubDate:     it.bp.Date.UTC().Format(time.RFC1123Z),
+			Categories:  it.bp.Tags,
+		})
+	}
+	return marshalXML(doc)
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomPerson  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published"`
+	Links      []atomLink     `xml:"link"`
+	Summary    *atomText      `xml:"summary,omitempty"`
+	Content    *atomText      `xml:"content,omitempty"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+func (b *blog) renderAtom(items []postItem, title, base, self string, modTime time.Time) ([]byte, error) {
+	feed := atomFeed{
+		Title:   title,
+		ID:      self,
+		Updated: modTime.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: base + "/", Rel: "alternate", Type: "text/html"},
+			{Href: self, Rel: "self", Type: feedAtom.ContentType()},
+		},
+		Author: atomPerson{Name: b.feedAuthor()},
+	}
+	for _, it := range items {
+		link := base + b.postPath(it.name, it.bp.Date)
+		ae := atomEntry{
+			Title:     it.bp.Title,
+			ID:        link,
+			Updated:   it.bp.LastModified().UTC().Format(time.RFC3339),
+			Published: it.bp.Date.UTC().Format(time.RFC3339),
+			Links:     []atomLink{{Href: link, Rel: "alternate", Type: "text/html"}},
+			Summary:   &atomText{Type: "text", Body: postSummary(it.bp)},
+		}
+		if !*feedSummary {
+			ae.Content = &atomText{Type: "html", Body: string(sanitizeContent(it.bp.Content))}
+		}
+		for _, t := range it.bp.Tags {
+			ae.Categories = append(ae.Categories, atomCategory{Term: t})
+		}
+		feed.Entries = append(feed.Entries, ae)
+	}
+	return marshalXML(feed)
+}
+
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Description string         `json:"description,omitempty"`
+	Authors     []jsonAuthor   `json:"authors"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedItem struct {
+	ID            string   `json:"id"`
+	URL           string   `json:"url"`
+	Title         string   `json:"title"`
+	ContentHTML   string   `json:"content_html,omitempty"`
+	ContentText   string   `json:"content_text,omitempty"`
+	Summary       string   `json:"summary,omitempty"`
+	DatePublished string   `json:"date_published"`
+	DateModified  string   `json:"date_modified"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+func (b *blog) renderJSONFeed(items []postItem, title, base, self string) ([]byte, error) {
+	feed := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       title,
+		HomePageURL: base + "/",
+		FeedURL:     self,
+		Description: b.site.Description,
+		Authors:     []jsonAuthor{{Name: b.feedAuthor()}},
+		Items:       []jsonFeedItem{},
+	}
+	for _, it := range items {
+		link := base + b.postPath(it.name, it.bp.Date)
+		jfi := jsonFeedItem{
+			ID:            link,
+			URL:           link,
+			Title:         it.bp.Title,
+			Summary:       postSummary(it.bp),
+			DatePublished: it.bp.Date.UTC().Format(time.RFC3339),
+			DateModified:  it.bp.LastModified().UTC().Format(time.RFC3339),
+			Tags:          it.bp.Tags,
+		}
+		if *feedSummary {
+			jfi.ContentText = jfi.Summary
+		} else {
+			jfi.ContentHTML = string(sanitizeContent(it.bp.Content))
+		}
+		feed.Items = append(feed.Items, jfi)
+	}
+	return json.MarshalIndent(feed, "", "\t")
+}
+
+func marshalXML(v interface{}) ([]byte, error) {
+	bb := bytes.NewBuffer([]byte(xml.Header))
+	enc := xml.NewEncoder(bb)
+	enc.Indent("", "\t")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bb.Bytes(), nil
+}
+
+// feedContent returns the HTML body that goes into an RSS description, post
+// content goes through the sanitizer just as it does on the site
+func feedContent(bp *blogpost.BlogPost) string {
+	if *feedSummary {
+		return html.EscapeString(postSummary(bp))
+	}
+	return string(sanitizeContent(bp.Content))
+}
+
+// feedAuthor is the author credited in feeds
+func (b *blog) feedAuthor() string {
+	if b.site.Author != "" {
+		return b.site.Author
+	}
+	return b.site.Name
+}
+
+// postSummary returns the author provided summary or a plain text summary
+// generated from the sanitized post content, cut on a word boundary
+func postSummary(bp *blogpost.BlogPost) string {
+	if bp.Summary != "" {
+		return bp.Summary
+	}
+	txt := contentText(bp)
+	if len(txt) <= summaryLength {
+		return txt
+	}
+	cut := strings.LastIndex(txt[:summaryLength], " ")
+	if cut <= 0 {
+		//no word break, cut on a character boundary instead
+		for cut = summaryLength; cut > 0 && !utf8.RuneStart(txt[cut]); cut-- {
+		}
+	}
+	return strings.TrimSpace(txt[:cut]) + "..."
+}
+
+// contentText returns the plain text of the sanitized post content, so
+// scripts, styles and anything else the sanitizer drops never show up in it
+func contentText(bp *blogpost.BlogPost) string {
+	return stripTags(string(sanitizeContent(bp.Content)))
+}
+
+// stripTags removes markup from an HTML fragment, unescapes entities and
+// collapses whitespace
+func stripTags(s string) string {
+	var bb bytes.Buffer
+	inTag := false
+	for _, c := range s {
+		switch {
+		case c == '<':
+			inTag = true
+		case c == '>' && inTag:
+			inTag = false
+			bb.WriteByte(' ')
+		case !inTag:
+			bb.WriteRune(c)
+		}
+	}
+	return strings.Join(strings.Fields(html.UnescapeString(bb.String())), " ")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+func TestFeedCacheKeys(t *testing.T) {
+	b := testBlog(t)
+	addTestPost(t, b, "a", 0, blogpost.BlogPost{Tags: []string{"go"}})
+	get := func(host, p string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", p, nil)
+		req.Host = host
+		b.tagHandler(rec, req)
+		return rec.Code
+	}
+
+	//without a base URL documents carry the Host header and are not kept
+	b.baseURL = ""
+	for _, h := range []string{"a.example", "b.example"} {
+		if code := get(h, "/tag/go/feed.xml"); code != http.StatusOK {
+			t.Fatalf("tag feed status %d", code)
+		}
+	}
+	if n := len(b.docs.entries); n != 0 {
+		t.Fatalf("%d documents cached without a base URL", n)
+	}
+
+	b.baseURL = "https://example.com"
+	if code := get("a.example", "/tag/nope/feed.xml"); code != http.StatusNotFound {
+		t.Fatalf("feed of a missing tag status %d", code)
+	}
+	get("a.example", "/tag/go/feed.xml")
+	get("b.example", "/tag/go/feed.xml")
+	get("b.example", "/tag/go/atom.xml")
+	if n := len(b.docs.entries); n != 2 {
+		t.Fatalf("%d documents cached, wanted 2", n)
+	}
+
+	//a new generation drops the old entries as soon as anything is stored
+	addTestPost(t, b, "b", 1, blogpost.BlogPost{Tags: []string{"go"}})
+	get("a.example", "/tag/go/feed.xml")
+	if n := len(b.docs.entries); n != 1 {
+		t.Fatalf("%d documents cached after a change, wanted 1", n)
+	}
+}
+
+func TestFeedContentSanitized(t *testing.T) {
+	b := testBlog(t)
+	addTestPost(t, b, "x", 0, blogpost.BlogPost{
+		Content: `<p onclick="evil()">hi</p><script>evil()</script>`,
+		Tags:    []string{"go"},
+	})
+	for f := range feedFiles {
+		rec := httptest.NewRecorder()
+		b.tagHandler(rec, httptest.NewRequest("GET", "/tag/go/"+f, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", f, rec.Code)
+		}
+		if body := rec.Body.String(); !strings.Contains(body, "hi") || strings.Contains(body, "evil") {
+			t.Fatalf("%s: unsanitized content %q", f, body)
+		}
+	}
+}
+
+func TestPostSummary(t *testing.T) {
+	long := strings.Repeat("word ", 100)
+	unbroken := strings.Repeat("é", summaryLength)
+	for _, tc := range []struct {
+		content, want string
+	}{
+		{"<p>Short &amp; sweet</p>", "Short & sweet"},
+		{long, strings.TrimSpace(long[:strings.LastIndex(long[:summaryLength], " ")]) + "..."},
+		{unbroken, unbroken[:summaryLength] + "..."},
+		{"x" + unbroken, "x" + unbroken[:summaryLength-2] + "..."},
+	} {
+		got := postSummary(&blogpost.BlogPost{Content: tc.content})
+		if got != tc.want {
+			t.Fatalf("summary of %.20q is %q, wanted %q", tc.content, got, tc.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Fatalf("summary %q is not valid UTF-8", got)
+		}
+	}
+}
@@ -3,113 +3,269 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"net"
 	"net/http"
 	"os"
-	"os/signal"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
 )
 
 var (
-	root                 = flag.String("root", "/tmp/files", "Root directory for serving files")
-	addr                 = flag.String("addr", "", "Address to bind to")
-	port                 = flag.Int("port", 80, "port to listen on")
-	logFile              = flag.String("log-file", "/var/log/access.log", "Log file to output to")
-	templateDir          = flag.String("templates", "/opt/templates/", "directory containing templates")
-	postDB               = flag.String("postdb", "", "Database file path")
-	passFile             = flag.String("passfile", "", "Password file")
-	outLog      *os.File = nil
+	root              = flag.String("root", "", "Root directory for serving files, files it lacks come from the embedded webroot")
+	addr              = flag.String("addr", "", "Address to bind to")
+	port              = flag.Int("port", 80, "port to listen on")
+	logFile           = flag.String("log-file", "/var/log/access.log", "Log file to output to")
+	templateDir       = flag.String("templates", "", "directory containing templates, templates it lacks come from the embedded theme")
+	postDB            = flag.String("postdb", "", "Database file path")
+	passFile          = flag.String("passfile", "", "Password file")
+	baseURL           = flag.String("base-url", "", "Absolute base URL of the site used in feeds, e.g. https://example.com")
+	siteTitle         = flag.String("site-title", "Traetox.net", "Site name used in pages and feeds")
+	siteTagline       = flag.String("site-tagline", "Embedded Reverse Engineering and Tinkering with homebrew", "Site tagline shown in page titles")
+	siteDesc          = flag.String("site-description", "Reverse Engineering, Embedded Security, Homebrew", "Site description used in pages and feeds")
+	siteAuthor        = flag.String("site-author", "traetox", "Site author used in pages and feeds, feeds fall back to the site name")
+	siteSocial        = flag.String("site-social", "", "Comma separated list of Name=URL social links")
+	siteAnalytics     = flag.String("site-analytics", "", "File holding an HTML analytics snippet added to every page")
+	siteFooter        = flag.String("site-footer", "Copyright &copy; traetox 2015", "HTML footer text")
+	feedSummary       = flag.Bool("feed-summary", false, "Publish post summaries in feeds instead of full content")
+	feedLength        = flag.Int("feed-length", 20, "Maximum number of posts in a feed")
+	apiOrigins        = flag.String("api-cors-origins", "", "Comma separated list of origins allowed to use the JSON API, * allows any")
+	apiDrafts         = flag.Bool("api-drafts", false, "Expose draft posts through the JSON API")
+	robotsFile        = flag.String("robots", "", "robots.txt file to serve, a default allowing everything is served if empty")
+	tmplPoll          = flag.Duration("template-poll", 2*time.Second, "Interval to check templates for changes, 0 disables reloading")
+	exportDir         = flag.String("out", "", "Output directory for the export command")
+	sanitizePolicy    = flag.String("sanitize-policy", policyUGC, "HTML sanitizer policy applied to post content: ugc, strict or none")
+	redirectsFile     = flag.String("redirects", "", "File of redirects to import at startup, lines of <path> <target> [301|302] or <path> 410")
+	cacheControl      = flag.String("cache-control", "no-cache", "Cache-Control header for rendered pages and feeds, empty sends none")
+	staticCache       = flag.String("static-cache-control", "public, max-age=86400", "Cache-Control header for static files, empty sends none")
+	pageCacheMB       = flag.Int("page-cache", 16, "Memory budget in MiB for rendered pages, 0 disables the page cache")
+	precompress       = flag.Bool("precompress", true, "Write .br and .gz copies of compressible static files at startup")
+	readTimeout       = flag.Duration("read-timeout", 10*time.Second, "Maximum time to read a request")
+	writeTimeout      = flag.Duration("write-timeout", 60*time.Second, "Maximum time to write a response")
+	idleTimeout       = flag.Duration("idle-timeout", 2*time.Minute, "Maximum time an idle keep-alive connection is kept open")
+	shutdownTimeout   = flag.Duration("shutdown-timeout", 30*time.Second, "Maximum time to wait for in flight requests when stopping or restarting")
+	permalinkFmt      = flag.String("permalink", "/"+permSlug, "URL pattern for posts made of :year, :month, :day, :slug and literal segments, e.g. /:year/:month/:slug/")
+	tlsCert           = flag.String("tls-cert", "", "TLS certificate file, reloaded when it changes")
+	tlsKey            = flag.String("tls-key", "", "TLS private key file, reloaded when it changes")
+	tlsPort           = flag.Int("tls-port", 443, "port to serve HTTPS on when TLS is configured")
+	httpsRedirect     = flag.Bool("https-redirect", true, "Redirect plain HTTP requests to HTTPS when TLS is configured")
+	hstsMaxAge        = flag.Duration("hsts", 365*24*time.Hour, "Strict-Transport-Security max-age sent over HTTPS, 0 sends none")
+	acmeDomains       = flag.String("acme-domains", "", "Comma separated list of domains to obtain certificates for over ACME")
+	acmeEmail         = flag.String("acme-email", "", "Contact email for the ACME account")
+	acmeDirectory     = flag.String("acme-directory", autocert.DefaultACMEDirectory, "ACME directory URL")
+	acmeCA            = flag.String("acme-ca", "", "PEM file of CA certificates to trust when talking to the ACME server, e.g. for Pebble")
+	acmeCache         = flag.String("acme-cache", "", "Directory to keep ACME account keys and certificates in")
+	cspPolicy         = flag.String("csp", "default-src 'self'; img-src 'self' data: https:; object-src 'none'; base-uri 'self'; form-action 'self'", "Content-Security-Policy for every response, a nonce for inline scripts is added to script-src, empty sends none")
+	cspReportOnly     = flag.Bool("csp-report-only", false, "Send the CSP as Content-Security-Policy-Report-Only, reporting violations without blocking")
+	frameAncestors    = flag.String("frame-ancestors", "'self'", "CSP frame-ancestors sources allowed to frame pages, also sent as X-Frame-Options where it can be")
+	referrerPolicy    = flag.String("referrer-policy", "strict-origin-when-cross-origin", "Referrer-Policy header, empty sends none")
+	permissionsPolicy = flag.String("permissions-policy", "camera=(), microphone=(), geolocation=(), payment=()", "Permissions-Policy header, empty sends none")
+	updateAllow       = flag.String("update-allow", "", "Comma separated list of CIDRs allowed to push updates, empty allows any address")
+	updateRate        = flag.Float64("update-rate", 6, "Update challenges and pushes allowed per minute from one address, 0 disables rate limiting")
+	updateBurst       = flag.Int("update-burst", 3, "Update challenges or pushes one address may make at once before being rate limited")
+	updateFailures    = flag.Int("update-lockout-after", 5, "Malformed or unauthenticated update pushes from one address before it is locked out, 0 disables lockouts")
+	updateLockout     = flag.Duration("update-lockout", time.Minute, "Lockout after the first run of failed update authentications, doubling with each further failure")
+	challengeTTL      = flag.Duration("update-challenge-ttl", time.Minute, "How long an update challenge may be used for before the client has to fetch another")
+	updateMaxLockout  = flag.Duration("update-max-lockout", 24*time.Hour, "Longest lockout from updates")
+	configFile        = flag.String("config", "", "Config file to read settings from, flags override it")
+	checkCfg          = flag.Bool("check-config", false, "Validate the configuration and templates then exit")
+	command           = ""
+	httpsAddr         = ""
+
+	staticDirs = []string{"/pics/", "/files/", "/js/", "/css/", "/fonts/"}
 )
 
-func init() {
-	flag.Parse()
-	if *root == "" {
-		fmt.Printf("ERROR: I need a root directory to serve files from\n")
-		os.Exit(-1)
+const (
+	exportCmd     = `export`
+	checkHTMLCmd  = `check-html`
+	deletePageCmd = `delete-page`
+)
+
+// configure parses the command line and any config file and validates the
+// result, it is kept out of init so the package can be tested
+func configure(args []string) error {
+	if len(args) > 0 && (args[0] == exportCmd || args[0] == checkHTMLCmd || args[0] == deletePageCmd) {
+		command = args[0]
+		args = args[1:]
 	}
-	if *port <= 0 || *port >= 0xffff {
-		fmt.Printf("ERROR: I need a usable port to serve on (0 > port > %d)\n", 0xffff)
-		os.Exit(-1)
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
 	}
-	if *postDB == "" {
-		fmt.Printf("ERROR: I need a post DB path\n")
-		os.Exit(-1)
+	if *configFile != "" {
+		vals, err := applyConfigFile(flag.CommandLine, *configFile)
+		if err != nil {
+			return err
+		}
+		vhosts = newVhosts(vals)
+		if headerRoutes, err = newRouteHeaders(*configFile, vals); err != nil {
+			return err
+		}
 	}
-	if *passFile == "" {
-		fmt.Printf("ERROR: I need a password file\n")
-		os.Exit(-1)
+	if err := validateConfig(); err != nil {
+		return err
 	}
+	httpsAddr = fmt.Sprintf("%s:%d", *addr, *tlsPort)
 	if *port != 0 {
 		*addr = fmt.Sprintf("%s:%d", *addr, *port)
 	}
+	return nil
+}
 
-	fi, err := os.Stat(*root)
-	if err != nil {
-		fmt.Printf("ERROR: %s does not exist\t%v\n", *root, err)
-		os.Exit(-1)
-	}
-	if !fi.IsDir() {
-		fmt.Printf("ERROR: %s is not a directory\n", *root)
+func main() {
+	if err := configure(os.Args[1:]); err != nil {
+		printConfigError(err)
 		os.Exit(-1)
 	}
-	outLog, err = os.OpenFile(*logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
-	if err != nil {
-		fmt.Printf("ERROR opening the log file %v\t%v\n", *logFile, err)
-		os.Exit(-1)
+	if *checkCfg {
+		if err := checkConfig(); err != nil {
+			printConfigError(err)
+			os.Exit(-1)
+		}
+		fmt.Printf("Configuration OK\n")
+		return
 	}
-	_, err = outLog.Seek(0, 2)
+	blogs, err := newBlogs(siteConfigs())
 	if err != nil {
-		fmt.Printf("Error seeking to end of log file\n")
+		fmt.Printf("ERROR %v\n", err)
 		os.Exit(-1)
 	}
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
-	go func() {
-		<-c
-		if outLog != nil {
-			outLog.Close()
+	for _, b := range blogs {
+		if err := b.openLog(); err != nil {
+			fmt.Printf("ERROR %v\n", err)
+			os.Exit(-1)
 		}
-		ClosePostDB()
-		os.Exit(0)
-	}()
-}
-
-func main() {
-	defer outLog.Close()
+		defer b.closeLog()
+	}
 
-	bts, err := ioutil.ReadFile(*passFile)
-	if err != nil {
-		fmt.Printf("Failed to read password file: %v\n", err)
+	//commands work on the default site
+	switch command {
+	case exportCmd:
+		if err := blogs[0].runExport(*exportDir); err != nil {
+			fmt.Printf("Export failed: %v\n", err)
+			os.Exit(-1)
+		}
 		return
-	}
-	if err := SetUpdatePassbytes(bts); err != nil {
-		fmt.Printf("Failed to set password: %v\n", err)
+	case checkHTMLCmd:
+		if n, err := blogs[0].runCheckHTML(); err != nil {
+			fmt.Printf("HTML check failed: %v\n", err)
+			os.Exit(-1)
+		} else if n > 0 {
+			os.Exit(1)
+		}
+		return
+	case deletePageCmd:
+		if err := blogs[0].runDeletePage(flag.Args()); err != nil {
+			fmt.Printf("Page delete failed: %v\n", err)
+			os.Exit(-1)
+		}
 		return
 	}
 
-	if err := InitPostDB(*postDB); err != nil {
-		fmt.Printf("Failed to init post DB: %v\n", err)
-		return
+	var dbWait time.Duration
+	if inheritedListener() {
+		//the process we are replacing holds the DBs until it sees us running
+		dbWait = *shutdownTimeout + handoffGrace
 	}
-	defer ClosePostDB()
+	for _, b := range blogs {
+		if err := b.loadPassword(); err != nil {
+			fmt.Printf("Failed to read password file for the %v: %v\n", b, err)
+			return
+		}
+		if err := b.openDB(dbWait); err != nil {
+			fmt.Printf("Failed to init post DB for the %v: %v\n", b, err)
+			return
+		}
+		defer b.closeDB()
+		if err := b.importRedirects(); err != nil {
+			fmt.Printf("Failed to import redirects for the %v: %v\n", b, err)
+			return
+		}
+		if _, err := b.checkPostHTML(os.Stdout); err != nil {
+			fmt.Printf("Failed to check post HTML for the %v: %v\n", b, err)
+			return
+		}
+	}
+	SetPageCache(int64(*pageCacheMB) << 20)
 
-	//grab handle on listener
-	lst, err := net.Listen("tcp", *addr)
+	//grab handle on listeners, HTTP first so restarts hand them over in order
+	addrs := []string{*addr}
+	if tlsEnabled() {
+		addrs = append(addrs, httpsAddr)
+	}
+	lsts, err := listen(addrs...)
 	if err != nil {
 		fmt.Printf("Failed to get listener: %v\n", err)
 		return
 	}
+	h := securityHandler(compressHandler(newHostMux(blogs)), headerRoutes)
+	eps := []endpoint{{lst: lsts[0], handler: h}}
+	if tlsEnabled() {
+		cfg, plain, err := setupTLS(h)
+		if err != nil {
+			fmt.Printf("Failed to set up TLS: %v\n", err)
+			return
+		}
+		eps[0].handler = plain
+		eps = append(eps, endpoint{lst: lsts[1], handler: hstsHandler(h), tls: cfg})
+	}
 
-	if err := SetMainTemplateFile(*templateDir + "/main.template"); err != nil {
-		fmt.Printf("Failed to find main template: %v\n", err)
-		return
+	stop := make(chan struct{})
+	defer close(stop)
+	roots := map[string]bool{}
+	for _, b := range blogs {
+		if err := b.loadTemplates(); err != nil {
+			fmt.Printf("Failed to load templates for the %v: %v\n", b, err)
+			return
+		}
+		if *tmplPoll > 0 {
+			go b.templates.Watch(*tmplPoll, stop)
+		}
+		if b.root != "" {
+			roots[b.root] = true
+		}
 	}
+	if *precompress {
+		//files are compressed on the fly until their sidecars exist, and a
+		//read only root just means they always are
+		go func() {
+			for r := range roots {
+				if n, err := precompressStatic(r, staticDirs); err != nil {
+					fmt.Printf("Failed to precompress static files: %v\n", err)
+				} else if n > 0 {
+					fmt.Printf("Precompressed %d static files in %s\n", n, r)
+				}
+			}
+		}()
+	}
+	release := func() {
+		for _, b := range blogs {
+			if err := b.db.Close(); err != nil {
+				fmt.Printf("ERROR closing the post DB for the %v: %v\n", b, err)
+			}
+		}
+	}
+	if err := serve(eps, release); err != nil && err != http.ErrServerClosed {
+		fmt.Printf("Server failed: %v\n", err)
+	}
+}
+
+func (b *blog) newMux() *http.ServeMux {
 	mux := http.NewServeMux()
-	dirs := []string{"/pics/", "/files/", "/js/", "/css/", "/fonts"}
-	for i := range dirs {
-		mux.Handle(dirs[i], LogAndServe(http.StripPrefix(dirs[i], http.FileServer(http.Dir(*root+dirs[i])))))
+	for _, d := range staticDirs {
+		mux.Handle(d, b.LogAndServe(http.StripPrefix(d, b.staticFileServer(d))))
 	}
-	mux.HandleFunc("/", templateHandler)
-	mux.HandleFunc("/update", postUpdateHandler)
-	panic(http.Serve(lst, mux))
+	mux.HandleFunc("/", b.templateHandler)
+	mux.Handle("/feed.xml", b.LogAndServe(b.feedHandler(feedRSS)))
+	mux.Handle("/atom.xml", b.LogAndServe(b.feedHandler(feedAtom)))
+	mux.Handle("/feed.json", b.LogAndServe(b.feedHandler(feedJSON)))
+	mux.HandleFunc("/tag/", b.tagHandler)
+	mux.HandleFunc("/archive", b.archiveHandler)
+	mux.HandleFunc("/search", b.searchHandler)
+	mux.Handle("/search.json", b.LogAndServe(http.HandlerFunc(b.searchJSONHandler)))
+	mux.Handle(apiPrefix, b.LogAndServe(http.HandlerFunc(b.apiHandler)))
+	mux.Handle("/sitemap.xml", b.LogAndServe(http.HandlerFunc(b.sitemapHandler)))
+	mux.Handle("/robots.txt", b.LogAndServe(http.HandlerFunc(b.robotsHandler)))
+	mux.Handle(cspReportPath, b.LogAndServe(http.HandlerFunc(b.cspReportHandler)))
+	mux.HandleFunc("/update", b.postUpdateHandler)
+	mux.Handle("/debug/vars", b.LogAndServe(b.metricsHandler()))
+	return mux
 }
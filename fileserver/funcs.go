@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	wordsPerMinute = 200
+	fingerprintLen = 10
+)
+
+var (
+	assets = &assetCache{
+		entries: make(map[string]assetEntry, 1),
+	}
+
+	scriptTag = regexp.MustCompile(`(?i)<script\b`)
+)
+
+// templateFuncs is the function library available to every template
+func (b *blog) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"date":         formatDate,
+		"isoDate":      isoDate,
+		"ago":          timeAgo,
+		"readingTime":  readingTime,
+		"truncate":     truncateWords,
+		"truncateHTML": truncateHTML,
+		"absURL":       b.absURL,
+		"slugify":      slugify,
+		"tagURL":       tagPath,
+		"postURL":      b.postPath,
+		"asset":        b.assetPath,
+		"withNonce":    withNonce,
+	}
+}
+
+// formatDate formats t with a Go reference time layout, zero times print as
+// nothing rather than year one
+func formatDate(layout string, t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(layout)
+}
+
+func isoDate(t time.Time) string {
+	return formatDate(time.RFC3339, t)
+}
+
+// timeAgo renders t relative to now, e.g. "3 days ago"
+func timeAgo(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	d := time.Since(t)
+	if d < 0 {
+		return "just now"
+	}
+	plural := func(n int64, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s ago", unit)
+		}
+		return fmt.Sprintf("%d %ss ago", n, unit)
+	}
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return plural(int64(d/time.Minute), "minute")
+	case d < 24*time.Hour:
+		return plural(int64(d/time.Hour), "hour")
+	case d < 30*24*time.Hour:
+		return plural(int64(d/(24*time.Hour)), "day")
+	case d < 365*24*time.Hour:
+		return plural(int64(d/(30*24*time.Hour)), "month")
+	}
+	return plural(int64(d/(365*24*time.Hour)), "year")
+}
+
+// readingTime estimates the minutes needed to read HTML content, never less
+// than one
+func readingTime(content interface{}) int {
+	words := len(strings.Fields(stripTags(toString(content))))
+	mins := (words + wordsPerMinute - 1) / wordsPerMinute
+	if mins < 1 {
+		mins = 1
+	}
+	return mins
+}
+
+// truncateWords reduces HTML or text to at most n words of plain text,
+// appending an ellipsis if anything was cut
+func truncateWords(n int, content interface{}) string {
+	words := strings.Fields(stripTags(toString(content)))
+	if len(words) <= n {
+		return strings.Join(words, " ")
+	}
+	return strings.Join(words[:n], " ") + "..."
+}
+
+// truncateHTML cuts trusted HTML after n words of text, closing any elements
+// left open so the result is still well formed.  Only already trusted HTML
+// goes in, and nothing but its own tokens comes out, so the result stays
+// trusted.
+func truncateHTML(n int, content template.HTML) template.HTML {
+	var sb strings.Builder
+	var open []string
+	words := 0
+	z := html.NewTokenizer(strings.NewReader(string(content)))
+	for words < n {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return content
+		}
+		tok := z.Token()
+		switch tt {
+		case html.TextToken:
+			fields := strings.FieldsFunc(tok.Data, unicode.IsSpace)
+			if words+len(fields) > n {
+				tok.Data = strings.Join(fields[:n-words], " ") + "..."
+				words = n
+			} else {
+				words += len(fields)
+			}
+		case html.StartTagToken:
+			if !voidElement(tok.Data) {
+				open = append(open, tok.Data)
+			}
+		case html.EndTagToken:
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == tok.Data {
+					open = open[:i]
+					break
+				}
+			}
+		}
+		sb.WriteString(tok.String())
+	}
+	//check if there was anything left, if not the content was short enough
+	if z.Next() == html.ErrorToken && z.Err() == io.EOF {
+		return content
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		sb.WriteString("</" + open[i] + ">")
+	}
+	return template.HTML(sb.String())
+}
+
+func voidElement(tag string) bool {
+	switch tag {
+	case "area", "base", "br", "col", "embed", "hr", "img", "input", "link", "meta", "source", "track", "wbr":
+		return true
+	}
+	return false
+}
+
+// absURL resolves a site relative path against the configured base URL, if
+// no base URL is configured the path is returned unchanged
+func (b *blog) absURL(p string) string {
+	if b.baseURL == "" {
+		return p
+	}
+	return strings.TrimRight(b.baseURL, "/") + "/" + strings.TrimLeft(p, "/")
+}
+
+// slugify lower cases s and reduces it to letters and digits separated by
+// single dashes
+func slugify(s string) string {
+	var sb strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return sb.String()
+}
+
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case template.HTML:
+		return string(s)
+	case fmt.Stringer:
+		return s.String()
+	}
+	return fmt.Sprint(v)
+}
+
+type assetEntry struct {
+	modTime time.Time
+	hash    string
+}
+
+// assetCache remembers the content hash of static assets so fingerprinting
+// only rereads a file when its modification time changes
+type assetCache struct {
+	mtx     sync.Mutex
+	entries map[string]assetEntry
+}
+
+// assetPath adds a content fingerprint to a static asset path so it can be
+// cached forever and still change when the file does.  Paths that do not
+// exist in the webroot are returned unchanged.
+func (b *blog) assetPath(p string) string {
+	p = path.Clean("/" + p)
+	h, err := assets.hash(b.webroot, p[1:])
+	if err != nil {
+		return p
+	}
+	return p + "?v=" + h
+}
+
+// hash returns the fingerprint of a file in a webroot, embedded files never
+// change so their zero modification time is as good as any
+func (ac *assetCache) hash(webroot *layeredFS, file string) (string, error) {
+	fi, err := fs.Stat(webroot, file)
+	if err != nil {
+		return "", err
+	}
+	key := webroot.dir + "|" + file
+	ac.mtx.Lock()
+	defer ac.mtx.Unlock()
+	if ae, ok := ac.entries[key]; ok && ae.modTime.Equal(fi.ModTime()) {
+		return ae.hash, nil
+	}
+	fin, err := webroot.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer fin.Close()
+	hsh := sha256.New()
+	if _, err := io.Copy(hsh, fin); err != nil {
+		return "", err
+	}
+	ae := assetEntry{
+		modTime: fi.ModTime(),
+		hash:    hex.EncodeToString(hsh.Sum(nil))[:fingerprintLen],
+	}
+	ac.entries[key] = ae
+	return ae.hash, nil
+}
+
+// withNonce adds a CSP nonce to every script tag of trusted HTML, such as the
+// analytics snippet, so its inline scripts run under the policy
+func withNonce(h template.HTML, nonce string) template.HTML {
+	if nonce == "" {
+		return h
+	}
+	return template.HTML(scriptTag.ReplaceAllString(string(h), `<script nonce="`+template.HTMLEscapeString(nonce)+`"`))
+}
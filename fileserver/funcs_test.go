@@ -0,0 +1,78 @@
+package main
+
+import (
+	"html/template"
+	"testing"
+	"time"
+)
+
+func TestTruncateHTML(t *testing.T) {
+	for _, tc := range []struct {
+		in   template.HTML
+		n    int
+		want template.HTML
+	}{
+		{"<p>one two three</p>", 5, "<p>one two three</p>"},
+		{"<p>one two</p>", 2, "<p>one two</p>"},
+		{"<p>one two three</p>", 2, "<p>one two...</p>"},
+		//elements left open are closed in order
+		{"<p>one <b>two three</b> four</p>", 2, "<p>one <b>two...</b></p>"},
+		{"<ul><li>one</li><li>two three</li></ul>", 2, "<ul><li>one</li><li>two...</li></ul>"},
+		//void elements are not closed
+		{"<p>one<br>two three</p>", 2, "<p>one<br>two...</p>"},
+		{"<p>a &amp; b c</p>", 2, "<p>a &amp;...</p>"},
+		{"", 3, ""},
+	} {
+		if got := truncateHTML(tc.n, tc.in); got != tc.want {
+			t.Errorf("truncateHTML(%d, %q) = %q, wanted %q", tc.n, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	for in, want := range map[string]string{
+		"Hello, World!":   "hello-world",
+		"  Go 1.21  ":     "go-1-21",
+		"a--b__c":         "a-b-c",
+		"Ünïcode Café":    "ünïcode-café",
+		"---":             "",
+		"already-a-slug":  "already-a-slug",
+		"Tabs\tand\nnews": "tabs-and-news",
+	} {
+		if got := slugify(in); got != want {
+			t.Errorf("slugify(%q) = %q, wanted %q", in, got, want)
+		}
+	}
+}
+
+func TestTimeAgo(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		t    time.Time
+		want string
+	}{
+		{time.Time{}, ""},
+		{now.Add(time.Hour), "just now"},
+		{now.Add(-30 * time.Second), "just now"},
+		{now.Add(-61 * time.Second), "1 minute ago"},
+		{now.Add(-45 * time.Minute), "45 minutes ago"},
+		{now.Add(-90 * time.Minute), "1 hour ago"},
+		{now.Add(-49 * time.Hour), "2 days ago"},
+		{now.AddDate(0, 0, -45), "1 month ago"},
+		{now.AddDate(0, 0, -200), "6 months ago"},
+		{now.AddDate(0, 0, -800), "2 years ago"},
+	} {
+		if got := timeAgo(tc.t); got != tc.want {
+			t.Errorf("%v: %q, wanted %q", now.Sub(tc.t), got, tc.want)
+		}
+	}
+}
+
+func TestTruncateWords(t *testing.T) {
+	if got := truncateWords(3, template.HTML("<p>one <b>two</b> three four</p>")); got != "one two three..." {
+		t.Fatalf("truncated to %q", got)
+	}
+	if got := readingTime(""); got != 1 {
+		t.Fatalf("empty post takes %d minutes", got)
+	}
+}
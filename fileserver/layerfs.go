@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+
+	"github.com/traetox/blogEngine"
+)
+
+var (
+	defaultTemplates = mustSub(blogEngine.Templates, "templates")
+	defaultWebroot   = mustSub(blogEngine.Webroot, "webroot")
+)
+
+func mustSub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// layeredFS serves files from a directory on disk, falling back to the
+// embedded defaults for anything the directory does not have, so a
+// directory only needs the files it overrides.  Without a directory only
+// the defaults are served.
+type layeredFS struct {
+	dir  string
+	disk fs.FS
+	base fs.FS
+}
+
+func newLayeredFS(dir string, base fs.FS) *layeredFS {
+	lfs := &layeredFS{
+		dir:  dir,
+		base: base,
+	}
+	if dir != "" {
+		lfs.disk = os.DirFS(dir)
+	}
+	return lfs
+}
+
+func (lfs *layeredFS) Open(name string) (fs.File, error) {
+	if lfs.disk != nil {
+		f, err := lfs.disk.Open(name)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return f, err
+		}
+	}
+	return lfs.base.Open(name)
+}
+
+// ReadDir merges the entries of both layers, entries on disk hide embedded
+// ones of the same name
+func (lfs *layeredFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	ents, err := fs.ReadDir(lfs.base, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	baseErr := err
+	if lfs.disk == nil {
+		return ents, baseErr
+	}
+	dents, err := fs.ReadDir(lfs.disk, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ents, baseErr
+		}
+		return nil, err
+	}
+	merged := make(map[string]fs.DirEntry, len(ents)+len(dents))
+	for _, e := range ents {
+		merged[e.Name()] = e
+	}
+	for _, e := range dents {
+		merged[e.Name()] = e
+	}
+	ents = ents[:0]
+	for _, e := range merged {
+		ents = append(ents, e)
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Name() < ents[j].Name() })
+	return ents, nil
+}
+
+// String names the layers for messages
+func (lfs *layeredFS) String() string {
+	if lfs.dir == "" {
+		return "the embedded defaults"
+	}
+	return lfs.dir + " over the embedded defaults"
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLayeredFS(t *testing.T) {
+	base := fstest.MapFS{
+		"css/site.css":  {Data: []byte("embedded site")},
+		"css/print.css": {Data: []byte("embedded print")},
+		"js/app.js":     {Data: []byte("embedded app")},
+	}
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"css/site.css":  "disk site",
+		"css/extra.css": "disk extra",
+		"pics/logo.png": "disk logo",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lfs := newLayeredFS(dir, base)
+
+	//files on disk override the embedded ones, the rest fall through
+	for name, want := range map[string]string{
+		"css/site.css":  "disk site",
+		"css/print.css": "embedded print",
+		"css/extra.css": "disk extra",
+		"js/app.js":     "embedded app",
+		"pics/logo.png": "disk logo",
+	} {
+		b, err := fs.ReadFile(lfs, name)
+		if err != nil || string(b) != want {
+			t.Errorf("%s read %q: %v", name, b, err)
+		}
+	}
+	if _, err := lfs.Open("css/nope.css"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing file opened: %v", err)
+	}
+
+	//directories list the entries of both layers once, sorted
+	for name, want := range map[string]string{
+		".":    "css js pics",
+		"css":  "extra.css print.css site.css",
+		"js":   "app.js",
+		"pics": "logo.png",
+	} {
+		ents, err := fs.ReadDir(lfs, name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var names []string
+		for _, e := range ents {
+			names = append(names, e.Name())
+		}
+		if got := strings.Join(names, " "); got != want {
+			t.Errorf("%s lists %q, wanted %q", name, got, want)
+		}
+	}
+	if _, err := fs.ReadDir(lfs, "nope"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing directory listed: %v", err)
+	}
+
+	//without a directory only the embedded files are served
+	emb := newLayeredFS("", base)
+	if b, err := fs.ReadFile(emb, "css/site.css"); err != nil || string(b) != "embedded site" {
+		t.Errorf("embedded only read %q: %v", b, err)
+	}
+	if ents, err := fs.ReadDir(emb, "css"); err != nil || len(ents) != 2 {
+		t.Errorf("embedded only listed %d entries: %v", len(ents), err)
+	}
+	if emb.String() != "the embedded defaults" || lfs.String() != dir+" over the embedded defaults" {
+		t.Errorf("layers named %q and %q", emb, lfs)
+	}
+}
+
+func TestDefaultTheme(t *testing.T) {
+	//the embedded theme loads on its own
+	b := testBlog(t)
+	if err := b.loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(defaultWebroot, "css/bootstrap.min.css"); err != nil {
+		t.Fatal(err)
+	}
+}
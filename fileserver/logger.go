@@ -34,16 +34,16 @@ func NewResponseCapture(rw http.ResponseWriter) *ResponseCapture {
 	}
 }
 
-func LogAndServe(handler http.Handler) http.Handler {
+func (b *blog) LogAndServe(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		rc := NewResponseCapture(w)
 		handler.ServeHTTP(rc, r)
-		logRequest(r, rc.Code())
+		b.logRequest(r, rc.Code())
 	})
 }
 
-func logRequest(r *http.Request, response int) {
-	if outLog == nil {
+func (b *blog) logRequest(r *http.Request, response int) {
+	if b.outLog == nil {
 		fmt.Printf("not outLog\n")
 		return
 	}
@@ -54,7 +54,7 @@ func logRequest(r *http.Request, response int) {
 	if err != nil {
 		addr = r.RemoteAddr
 	}
-	n, err := fmt.Fprintf(outLog, "%s.%03d %s %s %s%s %d [%s]\n", tmStr, nano, addr, r.Method, r.Host, r.URL, response, r.UserAgent())
+	n, err := fmt.Fprintf(b.outLog, "%s.%03d %s %s %s%s %d [%s]\n", tmStr, nano, addr, r.Method, r.Host, r.URL, response, r.UserAgent())
 	if err != nil {
 		fmt.Printf("Log error: %v\n", err)
 	}
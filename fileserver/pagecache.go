@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//rough per entry bookkeeping cost charged against the budget
+	cachedPageOverhead = 256
+)
+
+var (
+	rendered = &pageCache{
+		lru:     list.New(),
+		entries: make(map[pageKey]*list.Element, 1),
+		gens:    make(map[*blog]uint64, 1),
+	}
+)
+
+type genKey struct{}
+
+// pageKey identifies a rendered page by the blog and path it was served for
+type pageKey struct {
+	blog *blog
+	path string
+}
+
+// cachedPage is a fully rendered page along with its compressed forms and
+// what it was rendered from.  Posts lists the posts shown on the page, list pages
+// show every post or every post with ListTag and change whenever one does.
+// Nonced pages carry the nonce placeholder and differ on every request, they
+// are compressed as they are served.
+type cachedPage struct {
+	key     pageKey
+	ver     uint64
+	gen     uint64
+	modTime time.Time
+	etag    string
+	plain   []byte
+	nonced  bool
+	encoded map[string][]byte
+
+	posts   []string
+	list    bool
+	listTag string
+}
+
+func (cp *cachedPage) size() int64 {
+	n := int64(len(cp.key.path)+len(cp.plain)) + cachedPageOverhead
+	for _, b := range cp.encoded {
+		n += int64(len(b))
+	}
+	return n
+}
+
+// touches returns true if the change alters what the page shows
+func (cp *cachedPage) touches(pc postChange) bool {
+	if pc.Page {
+		return true
+	}
+	for _, n := range pc.Names {
+		for _, p := range cp.posts {
+			if n == p {
+				return true
+			}
+		}
+	}
+	if !cp.list {
+		return false
+	}
+	if cp.listTag == "" {
+		return true
+	}
+	for _, t := range pc.Tags {
+		if strings.EqualFold(t, cp.listTag) {
+			return true
+		}
+	}
+	return false
+}
+
+// pageCache holds rendered pages of every blog by path within a single
+// memory budget, evicting the least recently used.  Entries are dropped when a post they show
+// changes and are ignored once the template set they came from is replaced.
+// Gens holds the post DB generation of the last change to each blog, pages
+// rendered from an older generation may have missed it and are not stored.
+type pageCache struct {
+	mtx     sync.Mutex
+	budget  int64
+	used    int64
+	lru     *list.List
+	entries map[pageKey]*list.Element
+	gens    map[*blog]uint64
+}
+
+// SetPageCache sets the memory budget for rendered pages in bytes, a budget
+// of zero disables the cache
+func SetPageCache(budget int64) {
+	rendered.mtx.Lock()
+	defer rendered.mtx.Unlock()
+	rendered.budget = budget
+	rendered.nlEvict()
+}
+
+// get returns the cached page for a path of a blog if it was rendered with
+// the blog's current templates
+func (pc *pageCache) get(b *blog, p string) *cachedPage {
+	if b.templates == nil {
+		return nil
+	}
+	_, ver := b.templates.Get()
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+	e, ok := pc.entries[pageKey{blog: b, path: p}]
+	if !ok {
+		return nil
+	}
+	cp := e.Value.(*cachedPage)
+	if cp.ver != ver {
+		pc.nlRemove(e)
+		return nil
+	}
+	pc.lru.MoveToFront(e)
+	return cp
+}
+
+// enabled reports whether pages should be prepared for caching at all
+func (pc *pageCache) enabled() bool {
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+	return pc.budget > 0
+}
+
+func (pc *pageCache) put(cp *cachedPage) {
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+	if cp.size() > pc.budget || cp.gen < pc.gens[cp.key.blog] {
+		return
+	}
+	if e, ok := pc.entries[cp.key]; ok {
+		pc.nlRemove(e)
+	}
+	pc.entries[cp.key] = pc.lru.PushFront(cp)
+	pc.used += cp.size()
+	pc.nlEvict()
+}
+
+// invalidate drops the pages of a blog that a change to its posts touches
+func (pc *pageCache) invalidate(b *blog, chg postChange) {
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+	pc.gens[b] = chg.Gen
+	for e := pc.lru.Front(); e != nil; {
+		next := e.Next()
+		if cp := e.Value.(*cachedPage); cp.key.blog == b && cp.touches(chg) {
+			pc.nlRemove(e)
+		}
+		e = next
+	}
+}
+
+func (pc *pageCache) nlEvict() {
+	for pc.used > pc.budget && pc.lru.Len() > 0 {
+		pc.nlRemove(pc.lru.Back())
+	}
+}
+
+func (pc *pageCache) nlRemove(e *list.Element) {
+	cp := e.Value.(*cachedPage)
+	pc.lru.Remove(e)
+	delete(pc.entries, cp.key)
+	pc.used -= cp.size()
+}
+
+// newCachedPage prepares a rendered page for the cache, working out what it
+// depends on from the page data.  Search and error pages are never cached.
+func newCachedPage(key pageKey, ver uint64, pd *pageData) (*cachedPage, bool) {
+	cp := &cachedPage{key: key, ver: ver}
+	switch pd.Page {
+	case pagePost, pagePage:
+		cp.posts = []string{pd.Name}
+	case pageIndex, pageArchive:
+		cp.list = true
+	case pageTag:
+		cp.list = true
+		cp.listTag = pd.Tag
+	default:
+		return nil, false
+	}
+	return cp, true
+}
+
+// compress fills in every compressed form of the page
+func (cp *cachedPage) compress() error {
+	if cp.nonced {
+		return nil
+	}
+	cp.encoded = make(map[string][]byte, len(encodings))
+	for _, coding := range encodings {
+		b, err := encodeBytes(coding, cp.plain)
+		if err != nil {
+			return err
+		}
+		cp.encoded[coding] = b
+	}
+	return nil
+}
+
+// serveCachedPage writes a rendered page, precompressed if the client takes
+// one of the stored codings, letting ServeContent answer conditional requests.
+// The compression handler gives each coding its own ETag.  Nonced pages get
+// the request's nonce, their ETag covers the placeholder so it stays the same
+// from one request to the next.
+func serveCachedPage(w http.ResponseWriter, r *http.Request, cp *cachedPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if *cacheControl != "" {
+		w.Header().Set("Cache-Control", *cacheControl)
+	}
+	w.Header().Set("ETag", cp.etag)
+	body := cp.plain
+	if cp.nonced {
+		body = withRequestNonce(r, cp.plain)
+		w = &keepPolicyWriter{ResponseWriter: w}
+	}
+	var offered []string
+	for _, coding := range encodings {
+		if _, ok := cp.encoded[coding]; ok {
+			offered = append(offered, coding)
+		}
+	}
+	if coding := preferredEncoding(r, offered...); coding != "" {
+		body = cp.encoded[coding]
+		w.Header().Set("Content-Encoding", coding)
+	}
+	http.ServeContent(w, r, "", cp.modTime, bytes.NewReader(body))
+}
+
+// withGeneration notes the post DB generation in a request before anything
+// is read from the DB for it.  servePage only caches pages rendered from a
+// generation no change has moved past.
+func (b *blog) withGeneration(r *http.Request) *http.Request {
+	if b.db == nil {
+		return r
+	}
+	gen, _ := b.db.Generation()
+	return r.WithContext(context.WithValue(r.Context(), genKey{}, gen))
+}
+
+// requestGeneration returns the generation noted by withGeneration
+func requestGeneration(r *http.Request) (uint64, bool) {
+	gen, ok := r.Context().Value(genKey{}).(uint64)
+	return gen, ok
+}
+
+// serveFromCache serves a GET or HEAD for a cached page, returning false on a miss
+func (b *blog) serveFromCache(rc *ResponseCapture, r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	cp := rendered.get(b, r.URL.Path)
+	if cp == nil {
+		return false
+	}
+	serveCachedPage(rc, r, cp)
+	return true
+}
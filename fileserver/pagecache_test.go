@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+func TestPageCacheStalePut(t *testing.T) {
+	SetPageCache(1 << 20)
+	defer SetPageCache(0)
+	b := testBlog(t)
+	addTestPost(t, b, "first", 0, blogpost.BlogPost{})
+
+	//a page rendered while a post changes must not outlive the change
+	r := b.withGeneration(httptest.NewRequest("GET", "/", nil))
+	gen, ok := requestGeneration(r)
+	if !ok {
+		t.Fatal("no generation noted in the request")
+	}
+	addTestPost(t, b, "second", 1, blogpost.BlogPost{})
+	stale := &cachedPage{key: pageKey{blog: b, path: "/"}, gen: gen, list: true}
+	rendered.put(stale)
+	if cachedPath(b, "/") {
+		t.Fatal("page rendered before a change was cached")
+	}
+
+	r = b.withGeneration(httptest.NewRequest("GET", "/", nil))
+	if gen, _ = requestGeneration(r); gen == stale.gen {
+		t.Fatal("generation did not move with the change")
+	}
+	rendered.put(&cachedPage{key: pageKey{blog: b, path: "/"}, gen: gen, list: true})
+	if !cachedPath(b, "/") {
+		t.Fatal("current page was not cached")
+	}
+}
+
+func cachedPath(b *blog, p string) bool {
+	rendered.mtx.Lock()
+	defer rendered.mtx.Unlock()
+	_, ok := rendered.entries[pageKey{blog: b, path: p}]
+	return ok
+}
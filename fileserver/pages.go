@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+const (
+	pagesDbId = `staticpages`
+)
+
+var (
+	pagesBkt = []byte(pagesDbId)
+)
+
+var (
+	//the navbar the templates hard coded before it was built from pages,
+	//posts under these names become pages when the pages bucket is created
+	legacyMenu = []menuLink{
+		{Name: "about", Title: "About"},
+		{Name: "services", Title: "Services"},
+		{Name: "contact", Title: "Contact"},
+		{Name: "disclosure-policy", Title: "Disclosure Policy"},
+	}
+)
+
+type menuLink struct {
+	Name  string
+	Title string
+	URL   string
+}
+
+func (db *boltDB) nlInitPages() error {
+	return db.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(pagesBkt).Cursor()
+		for name, bpbuff := c.First(); name != nil; name, bpbuff = c.Next() {
+			var bp blogpost.BlogPost
+			if err := gob.NewDecoder(bytes.NewBuffer(bpbuff)).Decode(&bp); err != nil {
+				return err
+			}
+			db.pages[string(name)] = &bp
+		}
+		return nil
+	})
+}
+
+// AddPage stores a static page.  A post of the same name is removed in the
+// same transaction so the page is the only thing served at its URL.
+func (db *boltDB) AddPage(name string, bp *blogpost.BlogPost) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.db == nil {
+		return errNotOpen
+	}
+	bp.Updated = time.Now()
+	pc := postChange{Names: []string{name}, Page: true}
+	if obp, ok := db.cache[name]; ok {
+		pc.Tags = obp.Tags
+	}
+	if err := db.db.Update(func(tx *bolt.Tx) error {
+		buff, err := gobEncode(bp)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(pagesBkt).Put([]byte(name), buff); err != nil {
+			return err
+		}
+		if tx.Bucket(dbId).Get([]byte(name)) == nil {
+			return nil
+		}
+		return deletePost(tx, name)
+	}); err != nil {
+		return err
+	}
+	delete(db.cache, name)
+	db.pages[name] = bp
+	db.nlChanged(pc)
+	return db.invalidatePostListCache()
+}
+
+// GetPage returns the static page stored under name
+func (db *boltDB) GetPage(name string) (*blogpost.BlogPost, error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.db == nil {
+		return nil, errNotOpen
+	}
+	bp, ok := db.pages[name]
+	if !ok {
+		return nil, errNotFound
+	}
+	return bp, nil
+}
+
+// migratePages moves the posts the old hard coded navbar linked to into the
+// pages bucket, keeping their place and text in the menu.  It runs in the
+// transaction that creates the bucket so it only ever happens once.
+func migratePages(tx *bolt.Tx) error {
+	posts, pages := tx.Bucket(dbId), tx.Bucket(pagesBkt)
+	for i, ml := range legacyMenu {
+		buff := posts.Get([]byte(ml.Name))
+		if buff == nil {
+			continue
+		}
+		var bp blogpost.BlogPost
+		if err := gob.NewDecoder(bytes.NewBuffer(buff)).Decode(&bp); err != nil {
+			return err
+		}
+		bp.Kind = blogpost.KindPage
+		bp.MenuOrder = i + 1
+		bp.MenuTitle = ml.Title
+		nbuff, err := gobEncode(&bp)
+		if err != nil {
+			return err
+		}
+		if err := pages.Put([]byte(ml.Name), nbuff); err != nil {
+			return err
+		}
+		if err := deletePost(tx, ml.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeletePage removes a static page, and with it any menu entry
+func (db *boltDB) DeletePage(name string) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.db == nil {
+		return errNotOpen
+	}
+	if _, ok := db.pages[name]; !ok {
+		return errNotFound
+	}
+	if err := db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pagesBkt).Delete([]byte(name))
+	}); err != nil {
+		return err
+	}
+	delete(db.pages, name)
+	db.nlChanged(postChange{Names: []string{name}, Page: true})
+	return nil
+}
+
+// PageNames returns the names of every published static page, sorted
+func (db *boltDB) PageNames() ([]string, error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.db == nil {
+		return nil, errNotOpen
+	}
+	var names []string
+	for name, bp := range db.pages {
+		if bp.Published() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Menu returns the published pages with a menu order above zero, lowest
+// order first and ties broken by name
+func (db *boltDB) Menu() ([]menuLink, error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.db == nil {
+		return nil, errNotOpen
+	}
+	type menuEntry struct {
+		name string
+		bp   *blogpost.BlogPost
+	}
+	var entries []menuEntry
+	for name, bp := range db.pages {
+		if bp.Published() && bp.MenuOrder > 0 {
+			entries = append(entries, menuEntry{name, bp})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].bp.MenuOrder != entries[j].bp.MenuOrder {
+			return entries[i].bp.MenuOrder < entries[j].bp.MenuOrder
+		}
+		return entries[i].name < entries[j].name
+	})
+	links := make([]menuLink, 0, len(entries))
+	for _, e := range entries {
+		links = append(links, menuLink{
+			Name:  e.name,
+			Title: e.bp.MenuName(),
+			URL:   pagePath(e.name),
+		})
+	}
+	return links, nil
+}
+
+// siteMenu returns the menu for templates, a missing DB has no pages
+func (b *blog) siteMenu() []menuLink {
+	if b.db == nil {
+		return nil
+	}
+	links, err := b.db.Menu()
+	if err != nil {
+		return nil
+	}
+	return links
+}
+
+// runDeletePage removes the named static pages from the post DB.  A running
+// server holds the DB locked, so it has to be stopped first.
+func (b *blog) runDeletePage(names []string) error {
+	if err := b.openDB(0); err == bolt.ErrTimeout {
+		return fmt.Errorf("the post DB %s is in use, stop the server before deleting pages", b.postDB)
+	} else if err != nil {
+		return err
+	}
+	defer b.closeDB()
+	for _, name := range names {
+		if err := b.db.DeletePage(name); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		fmt.Printf("Deleted page %s\n", name)
+	}
+	return nil
+}
+
+func (b *blog) getPage(rc *ResponseCapture, r *http.Request, name string, bp *blogpost.BlogPost) error {
+	pd := b.newPageData(pagePage, *bp)
+	pd.Name = name
+	pd.Canonical = pagePath(name)
+	return b.servePage(rc, r, pd, bp.LastModified())
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+func TestMigratePages(t *testing.T) {
+	//a DB from before pages had only the posts bucket
+	f := filepath.Join(t.TempDir(), "old.db")
+	bdb, err := bolt.Open(f, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bdb.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucket(dbId)
+		if err != nil {
+			return err
+		}
+		for _, name := range []string{"contact", "about", "hello"} {
+			buff, err := gobEncode(&blogpost.BlogPost{Title: name, Date: time.Now()})
+			if err != nil {
+				return err
+			}
+			if err := bkt.Put([]byte(name), buff); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	bdb.Close()
+
+	db, err := NewBlogDB(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	menu, err := db.Menu()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(menu) != 2 || menu[0].Title != "About" || menu[1].Title != "Contact" {
+		t.Fatalf("bad migrated menu %+v", menu)
+	}
+	if _, err := db.Get("about"); err == nil {
+		t.Fatal("migrated page is still a post")
+	}
+	if _, err := db.Get("hello"); err != nil {
+		t.Fatal("ordinary post was migrated")
+	}
+
+	if err := db.DeletePage("about"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeletePage("about"); err != errNotFound {
+		t.Fatalf("deleting a missing page gave %v", err)
+	}
+	if menu, _ = db.Menu(); len(menu) != 1 {
+		t.Fatalf("deleted page left in the menu %+v", menu)
+	}
+}
+
+func TestPageReplacesPost(t *testing.T) {
+	b := testBlog(t)
+	addTestPost(t, b, "about", 0, blogpost.BlogPost{Tags: []string{"go"}, Aliases: []string{"me"}})
+	var chg postChange
+	b.db.OnChange(func(pc postChange) {
+		chg = pc
+	})
+	if err := b.db.AddPage("about", &blogpost.BlogPost{Title: "About", Kind: blogpost.KindPage}); err != nil {
+		t.Fatal(err)
+	}
+	if len(chg.Tags) != 1 || chg.Tags[0] != "go" {
+		t.Fatalf("change does not name the replaced post's tags: %+v", chg)
+	}
+	if _, err := b.db.Redirect("/me"); err != errNotFound {
+		t.Fatalf("replaced post's alias still stored: %v", err)
+	}
+	if hits, _ := b.db.Search("about"); len(hits) != 0 {
+		t.Fatalf("replaced post still indexed: %+v", hits)
+	}
+}
+
+func TestDeletePageLocked(t *testing.T) {
+	b := testBlog(t)
+	other, err := newBlog(b.siteConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.runDeletePage([]string{"about"}); err == nil || !strings.Contains(err.Error(), "stop the server") {
+		t.Fatalf("deleting from a DB in use gave %v", err)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+const (
+	//how often idle clients are dropped from the limiter
+	limiterSweep = time.Minute
+	//most clients the limiter keeps track of
+	limiterClients = 10000
+	//IPv6 clients are limited by the network a single site is given
+	ipv6ClientBits = 64
+)
+
+var (
+	//rejected /update requests by error code, served with the other expvars
+	updateRejections = expvar.NewMap("update_rejections")
+)
+
+// tokenBucket allows burst requests at once, refilling at rate per second
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take spends a token if there is one, returning how long until there is
+// when there is not
+func (tb *tokenBucket) take(now time.Time, rate float64, burst int) (bool, time.Duration) {
+	if tb.last.IsZero() {
+		tb.tokens = float64(burst)
+	} else if d := now.Sub(tb.last); d > 0 {
+		tb.tokens += d.Seconds() * rate
+		if tb.tokens > float64(burst) {
+			tb.tokens = float64(burst)
+		}
+	}
+	tb.last = now
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - tb.tokens) / rate * float64(time.Second))
+}
+
+// updateClient is what the limiter knows about one address
+type updateClient struct {
+	challenge   tokenBucket
+	push        tokenBucket
+	failures    int
+	lockedUntil time.Time
+	lastSeen    time.Time
+}
+
+// updateLimiter guards the update endpoint of a blog.  Only addresses in the
+// allowlist may publish at all, each address gets a token bucket for
+// challenges and another for pushes, and repeated authentication failures
+// lock an address out for a time that doubles with every further failure.
+// IPv6 addresses are grouped by /64, and once maxClients are tracked the
+// quietest client that is not locked out makes way for a new one.
+type updateLimiter struct {
+	mtx        sync.Mutex
+	allow      []*net.IPNet
+	rate       float64
+	burst      int
+	failLimit  int
+	lockout    time.Duration
+	maxLock    time.Duration
+	clients    map[string]*updateClient
+	maxClients int
+	lastSweep  time.Time
+	now        func() time.Time
+}
+
+// newUpdateLimiter builds a limiter from the update settings
+func newUpdateLimiter() (*updateLimiter, error) {
+	allow, err := parseCIDRs(*updateAllow)
+	if err != nil {
+		return nil, err
+	}
+	return &updateLimiter{
+		allow:      allow,
+		rate:       *updateRate / 60,
+		burst:      *updateBurst,
+		failLimit:  *updateFailures,
+		lockout:    *updateLockout,
+		maxLock:    *updateMaxLockout,
+		clients:    map[string]*updateClient{},
+		maxClients: limiterClients,
+		now:        time.Now,
+	}, nil
+}
+
+// parseCIDRs parses a comma separated list of CIDRs, bare addresses are
+// taken as a single host
+func parseCIDRs(v string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("bad address %q in update allowlist", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad CIDR %q in update allowlist", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// remoteIP returns the address a request came from without its port
+func remoteIP(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return addr
+}
+
+// clientKey returns what the limiter tracks addr under, the address itself
+// for IPv4 and its /64 for IPv6
+func clientKey(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil {
+		return addr
+	}
+	return ip.Mask(net.CIDRMask(ipv6ClientBits, 8*net.IPv6len)).String() + "/64"
+}
+
+// allowed reports whether the allowlist lets addr publish, everyone may when
+// there is no allowlist
+func (ul *updateLimiter) allowed(addr string) bool {
+	if len(ul.allow) == 0 {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range ul.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit decides whether a challenge or push from addr may go ahead,
+// returning the error to refuse it with if not
+func (ul *updateLimiter) admit(addr string, push bool) *blogpost.UpdateError {
+	if !ul.allowed(addr) {
+		updateRejections.Add(blogpost.UpdateNotAllowed, 1)
+		return updateError(blogpost.UpdateNotAllowed, "%s may not publish to this server", addr)
+	}
+	ul.mtx.Lock()
+	defer ul.mtx.Unlock()
+	now := ul.now()
+	ul.nlSweep(now)
+	key := clientKey(addr)
+	uc, ok := ul.clients[key]
+	if !ok {
+		if len(ul.clients) >= ul.maxClients && !ul.nlEvict(now) {
+			updateRejections.Add(blogpost.UpdateRateLimited, 1)
+			ue := updateError(blogpost.UpdateRateLimited, "too many clients, try again later")
+			ue.RetryAfter = retrySeconds(limiterSweep)
+			return ue
+		}
+		uc = &updateClient{}
+		ul.clients[key] = uc
+	}
+	uc.lastSeen = now
+	if now.Before(uc.lockedUntil) {
+		updateRejections.Add(blogpost.UpdateLockedOut, 1)
+		ue := updateError(blogpost.UpdateLockedOut, "too many failed attempts from %s", addr)
+		ue.RetryAfter = retrySeconds(uc.lockedUntil.Sub(now))
+		return ue
+	}
+	if ul.rate <= 0 {
+		return nil
+	}
+	tb := &uc.challenge
+	if push {
+		tb = &uc.push
+	}
+	if ok, wait := tb.take(now, ul.rate, ul.burst); !ok {
+		updateRejections.Add(blogpost.UpdateRateLimited, 1)
+		ue := updateError(blogpost.UpdateRateLimited, "too many requests from %s", addr)
+		ue.RetryAfter = retrySeconds(wait)
+		return ue
+	}
+	return nil
+}
+
+// failed records a push from addr that did not decode, refused with code,
+// locking the address out once it has failed too often
+func (ul *updateLimiter) failed(addr, code string) {
+	updateRejections.Add(code, 1)
+	if ul.failLimit <= 0 {
+		return
+	}
+	ul.mtx.Lock()
+	defer ul.mtx.Unlock()
+	uc, ok := ul.clients[clientKey(addr)]
+	if !ok {
+		return
+	}
+	uc.failures++
+	if uc.failures < ul.failLimit {
+		return
+	}
+	d := ul.lockout
+	for i := ul.failLimit; i < uc.failures && d < ul.maxLock; i++ {
+		d *= 2
+	}
+	if d > ul.maxLock {
+		d = ul.maxLock
+	}
+	uc.lockedUntil = ul.now().Add(d)
+	fmt.Printf("Locking %s out of updates for %v after %d failed attempts\n", clientKey(addr), d, uc.failures)
+}
+
+// succeeded clears the failures of addr after an authenticated push
+func (ul *updateLimiter) succeeded(addr string) {
+	ul.mtx.Lock()
+	defer ul.mtx.Unlock()
+	if uc, ok := ul.clients[clientKey(addr)]; ok {
+		uc.failures = 0
+	}
+}
+
+// nlSweep drops clients that are not locked out and have been quiet for
+// longer than the longest lockout, forgetting their failures
+func (ul *updateLimiter) nlSweep(now time.Time) {
+	if now.Sub(ul.lastSweep) < limiterSweep {
+		return
+	}
+	ul.lastSweep = now
+	idle := ul.maxLock
+	if idle < limiterSweep {
+		idle = limiterSweep
+	}
+	for addr, uc := range ul.clients {
+		if now.After(uc.lockedUntil) && now.Sub(uc.lastSeen) > idle {
+			delete(ul.clients, addr)
+		}
+	}
+}
+
+// nlEvict drops the quietest client that is not locked out, returning false
+// if every client is
+func (ul *updateLimiter) nlEvict(now time.Time) bool {
+	var quiet string
+	var seen time.Time
+	for key, uc := range ul.clients {
+		if now.Before(uc.lockedUntil) {
+			continue
+		}
+		if quiet == "" || uc.lastSeen.Before(seen) {
+			quiet, seen = key, uc.lastSeen
+		}
+	}
+	if quiet == "" {
+		return false
+	}
+	delete(ul.clients, quiet)
+	return true
+}
+
+// retrySeconds rounds a wait up to the whole seconds of a Retry-After
+func retrySeconds(wait time.Duration) int {
+	return int((wait + time.Second - 1) / time.Second)
+}
+
+// metricsHandler serves the expvars, including the update rejection counts,
+// to loopback clients and addresses allowed to publish
+func (b *blog) metricsHandler() http.Handler {
+	vars := expvar.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := remoteIP(r)
+		if ip := net.ParseIP(addr); ip == nil || !(ip.IsLoopback() || (len(b.limits.allow) > 0 && b.limits.allowed(addr))) {
+			b.errorPage(w, r, http.StatusNotFound)
+			return
+		}
+		vars.ServeHTTP(w, r)
+	})
+}
+
+// validateUpdateLimits checks the update endpoint settings
+func validateUpdateLimits() []string {
+	var ce []string
+	if _, err := parseCIDRs(*updateAllow); err != nil {
+		ce = append(ce, err.Error())
+	}
+	if *updateRate < 0 {
+		ce = append(ce, "update rate can not be negative")
+	}
+	if *updateRate > 0 && *updateBurst < 1 {
+		ce = append(ce, "update burst must be at least 1")
+	}
+	if *challengeTTL <= 0 {
+		ce = append(ce, "update challenge TTL must be positive")
+	}
+	if *updateFailures < 0 {
+		ce = append(ce, "update lockout failure count can not be negative")
+	}
+	if *updateFailures > 0 && (*updateLockout <= 0 || *updateMaxLockout < *updateLockout) {
+		ce = append(ce, "update lockout must be positive and no longer than the maximum lockout")
+	}
+	return ce
+}
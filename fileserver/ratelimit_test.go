@@ -0,0 +1,158 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+func testLimiter(t *testing.T, allow string) (*updateLimiter, *time.Time) {
+	nets, err := parseCIDRs(allow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000000, 0)
+	ul := &updateLimiter{
+		allow:      nets,
+		rate:       1,
+		burst:      2,
+		failLimit:  3,
+		lockout:    time.Minute,
+		maxLock:    4 * time.Minute,
+		clients:    map[string]*updateClient{},
+		maxClients: limiterClients,
+		now:        func() time.Time { return now },
+	}
+	return ul, &now
+}
+
+func TestUpdateRateLimit(t *testing.T) {
+	ul, now := testLimiter(t, "")
+	for i := 0; i < 2; i++ {
+		if ue := ul.admit("10.0.0.1", false); ue != nil {
+			t.Fatalf("challenge %d refused inside the burst: %v", i, ue)
+		}
+	}
+	if ue := ul.admit("10.0.0.1", false); ue == nil || ue.Code != blogpost.UpdateRateLimited || ue.RetryAfter != 1 {
+		t.Fatalf("challenge past the burst: %+v", ue)
+	}
+	//pushes and other addresses have buckets of their own
+	if ue := ul.admit("10.0.0.1", true); ue != nil {
+		t.Fatal("push refused by the challenge bucket")
+	}
+	if ue := ul.admit("10.0.0.2", false); ue != nil {
+		t.Fatal("other address refused")
+	}
+	*now = now.Add(time.Second)
+	if ue := ul.admit("10.0.0.1", false); ue != nil {
+		t.Fatal("challenge refused after a refill")
+	}
+}
+
+func TestUpdateLockout(t *testing.T) {
+	ul, now := testLimiter(t, "")
+	ul.rate = 0
+	fail := func(n int) {
+		for i := 0; i < n; i++ {
+			if ue := ul.admit("10.0.0.1", true); ue != nil {
+				t.Fatalf("push refused before lockout: %v", ue)
+			}
+			ul.failed("10.0.0.1", blogpost.UpdateAuthFailed)
+		}
+	}
+	fail(3)
+	ue := ul.admit("10.0.0.1", false)
+	if ue == nil || ue.Code != blogpost.UpdateLockedOut || ue.RetryAfter != 60 {
+		t.Fatalf("not locked out: %+v", ue)
+	}
+	//each further failure doubles the lockout up to the maximum
+	for _, want := range []int{120, 240, 240} {
+		*now = now.Add(time.Duration(ue.RetryAfter) * time.Second)
+		fail(1)
+		if ue = ul.admit("10.0.0.1", true); ue == nil || ue.RetryAfter != want {
+			t.Fatalf("lockout %+v, wanted %ds", ue, want)
+		}
+	}
+	*now = now.Add(time.Duration(ue.RetryAfter) * time.Second)
+	ul.succeeded("10.0.0.1")
+	fail(2)
+	if ue := ul.admit("10.0.0.1", true); ue != nil {
+		t.Fatal("failures not cleared by a success")
+	}
+}
+
+func TestUpdateAllowlist(t *testing.T) {
+	ul, _ := testLimiter(t, "192.0.2.0/24, 2001:db8::1")
+	for addr, want := range map[string]bool{
+		"192.0.2.7":   true,
+		"192.0.3.7":   false,
+		"2001:db8::1": true,
+		"2001:db8::2": false,
+		"junk":        false,
+	} {
+		ue := ul.admit(addr, true)
+		if (ue == nil) != want || (ue != nil && ue.Code != blogpost.UpdateNotAllowed) {
+			t.Fatalf("%s: got %v, wanted admitted %v", addr, ue, want)
+		}
+	}
+	if _, err := parseCIDRs("10.0.0.0/33"); err == nil {
+		t.Fatal("bad CIDR parsed")
+	}
+}
+
+func TestUpdateLimiterSweep(t *testing.T) {
+	ul, now := testLimiter(t, "")
+	ul.admit("10.0.0.1", true)
+	ul.failed("10.0.0.1", blogpost.UpdateAuthFailed)
+	*now = now.Add(time.Hour)
+	ul.admit("10.0.0.2", true)
+	if _, ok := ul.clients["10.0.0.1"]; ok || len(ul.clients) != 1 {
+		t.Fatalf("idle client kept: %d clients", len(ul.clients))
+	}
+}
+
+func TestUpdateLimiterIPv6(t *testing.T) {
+	ul, _ := testLimiter(t, "")
+	//every address of a /64 shares one bucket
+	for i, addr := range []string{"2001:db8:0:1::1", "2001:db8:0:1::2"} {
+		if ue := ul.admit(addr, true); ue != nil {
+			t.Fatalf("push %d refused inside the burst: %v", i, ue)
+		}
+	}
+	if ue := ul.admit("2001:db8:0:1:ffff::3", true); ue == nil || ue.Code != blogpost.UpdateRateLimited {
+		t.Fatalf("push from the same /64 past the burst: %+v", ue)
+	}
+	if ue := ul.admit("2001:db8:0:2::1", true); ue != nil {
+		t.Fatal("other /64 refused")
+	}
+	if n := len(ul.clients); n != 2 {
+		t.Fatalf("%d clients tracked, wanted 2", n)
+	}
+}
+
+func TestUpdateLimiterCap(t *testing.T) {
+	ul, now := testLimiter(t, "")
+	ul.maxClients = 2
+	ul.failLimit = 1
+	ul.admit("10.0.0.1", true)
+	ul.failed("10.0.0.1", blogpost.UpdateAuthFailed)
+	*now = now.Add(time.Second)
+	ul.admit("10.0.0.2", true)
+	//the quietest client that is not locked out makes way
+	*now = now.Add(time.Second)
+	if ue := ul.admit("10.0.0.3", true); ue != nil {
+		t.Fatalf("new client refused: %v", ue)
+	}
+	if _, ok := ul.clients["10.0.0.2"]; ok || len(ul.clients) != 2 {
+		t.Fatalf("wrong client evicted: %d clients", len(ul.clients))
+	}
+	//with everyone locked out new clients wait
+	ul.failed("10.0.0.3", blogpost.UpdateAuthFailed)
+	if ue := ul.admit("10.0.0.4", true); ue == nil || ue.Code != blogpost.UpdateRateLimited {
+		t.Fatalf("client past the cap: %+v", ue)
+	}
+	if ue := ul.admit("10.0.0.1", true); ue == nil || ue.Code != blogpost.UpdateLockedOut {
+		t.Fatalf("locked out client forgotten: %+v", ue)
+	}
+}
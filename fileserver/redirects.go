@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	redirectsDbId = `redirects`
+)
+
+var (
+	redirectsBkt = []byte(redirectsDbId)
+)
+
+// redirect is an entry in the redirect table.  Entries created from post
+// aliases follow the post so they keep pointing at its current URL, imported
+// entries point at a fixed target.  A code of 410 marks the path as gone.
+type redirect struct {
+	Post   string
+	Target string
+	Code   int
+}
+
+// aliasPath turns an alias, either a bare post name or a site path, into the
+// cleaned path used as the redirect table key
+func aliasPath(alias string) string {
+	return path.Clean("/" + strings.TrimSpace(alias))
+}
+
+// syncAliases points every alias of a post at it and drops aliases the post
+// no longer declares
+func syncAliases(tx *bolt.Tx, name string, aliases []string) error {
+	bkt := tx.Bucket(redirectsBkt)
+	want := map[string]bool{}
+	for _, a := range aliases {
+		if p := aliasPath(a); p != "/" && p != "/"+name {
+			want[p] = true
+		}
+	}
+	var stale [][]byte
+	c := bkt.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		var rd redirect
+		if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&rd); err != nil {
+			return err
+		}
+		if rd.Post == name && !want[string(k)] {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+	}
+	for _, k := range stale {
+		if err := bkt.Delete(k); err != nil {
+			return err
+		}
+	}
+	for p := range want {
+		if err := putRedirect(tx, p, redirect{Post: name, Code: http.StatusMovedPermanently}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uniqueAliases drops aliases that clean to the same path as an earlier one
+func uniqueAliases(aliases []string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, a := range aliases {
+		if p := aliasPath(a); !seen[p] {
+			seen[p] = true
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func putRedirect(tx *bolt.Tx, p string, rd redirect) error {
+	buff, err := gobEncode(rd)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(redirectsBkt).Put([]byte(p), buff)
+}
+
+// Redirect returns the redirect table entry for a path
+func (db *boltDB) Redirect(p string) (redirect, error) {
+	var rd redirect
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.db == nil {
+		return rd, errNotOpen
+	}
+	err := db.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(redirectsBkt).Get([]byte(p))
+		if v == nil {
+			return errNotFound
+		}
+		return gob.NewDecoder(bytes.NewBuffer(v)).Decode(&rd)
+	})
+	return rd, err
+}
+
+// ImportRedirects adds the entries to the redirect table, replacing any
+// entries already stored for the same paths
+func (db *boltDB) ImportRedirects(rds map[string]redirect) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.db == nil {
+		return errNotOpen
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		for p, rd := range rds {
+			if err := putRedirect(tx, p, rd); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// loadRedirectFile reads a redirect table, one entry per line:
+//
+//	<path> <target> [301|302]
+//	<path> 410
+//
+// Blank lines and lines starting with # are ignored.
+func loadRedirectFile(file string) (map[string]redirect, error) {
+	fin, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+	rds := map[string]redirect{}
+	s := bufio.NewScanner(fin)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		rd, err := parseRedirect(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		rds[aliasPath(fields[0])] = rd
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return rds, nil
+}
+
+func parseRedirect(fields []string) (redirect, error) {
+	rd := redirect{Code: http.StatusMovedPermanently}
+	switch len(fields) {
+	case 2:
+		if fields[1] == strconv.Itoa(http.StatusGone) {
+			rd.Code = http.StatusGone
+			return rd, nil
+		}
+		rd.Target = fields[1]
+	case 3:
+		code, err := strconv.Atoi(fields[2])
+		if err != nil || (code != http.StatusMovedPermanently && code != http.StatusFound) {
+			return rd, fmt.Errorf("bad redirect code %q", fields[2])
+		}
+		rd.Target = fields[1]
+		rd.Code = code
+	default:
+		return rd, fmt.Errorf("expected <path> <target> [code] or <path> %d", http.StatusGone)
+	}
+	if !strings.HasPrefix(rd.Target, "/") && !strings.Contains(rd.Target, "://") {
+		return rd, fmt.Errorf("target %q is neither a site path nor an absolute URL", rd.Target)
+	}
+	return rd, nil
+}
+
+// serveRedirect answers a path nothing else claimed from the redirect table,
+// trying each candidate path in turn.  Anything not in the table is a 404.
+func (b *blog) serveRedirect(rc *ResponseCapture, r *http.Request, paths ...string) error {
+	for _, p := range paths {
+		rd, err := b.db.Redirect(p)
+		if err == errNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if rd.Code == http.StatusGone {
+			b.errorPage(rc, r, http.StatusGone)
+			return nil
+		}
+		target := rd.Target
+		if rd.Post != "" {
+			bp, err := b.db.Get(rd.Post)
+			if err == errNotFound || (err == nil && !bp.Published()) {
+				break
+			} else if err != nil {
+				return err
+			}
+			target = b.postPath(rd.Post, bp.Date)
+		}
+		http.Redirect(rc, r, target, rd.Code)
+		return nil
+	}
+	b.errorPage(rc, r, http.StatusNotFound)
+	return nil
+}
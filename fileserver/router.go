@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	permYear  = `:year`
+	permMonth = `:month`
+	permDay   = `:day`
+	permSlug  = `:slug`
+)
+
+var (
+	//fixed pages that are redirected to when asked for with a trailing slash
+	slashRoutes = map[string]bool{"/archive": true, "/search": true}
+)
+
+// permalink is a parsed post URL pattern such as /:year/:month/:slug/.  A
+// trailing slash in the pattern makes the trailing slash part of the
+// canonical URL.
+type permalink struct {
+	segs     []string
+	trailing bool
+}
+
+// parsePermalink parses the URL pattern posts are served on.  Patterns are made
+// of / separated :year, :month, :day and :slug tokens and literal segments,
+// and must contain :slug exactly once.
+func parsePermalink(pattern string) (*permalink, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("permalink %q must start with /", pattern)
+	}
+	pl := &permalink{
+		trailing: len(pattern) > 1 && strings.HasSuffix(pattern, "/"),
+	}
+	slugs := 0
+	for _, s := range strings.Split(strings.Trim(pattern, "/"), "/") {
+		switch {
+		case s == permSlug:
+			slugs++
+		case s == permYear || s == permMonth || s == permDay:
+		case s == "" || strings.HasPrefix(s, ":"):
+			return nil, fmt.Errorf("permalink %q has a bad segment %q", pattern, s)
+		}
+		pl.segs = append(pl.segs, s)
+	}
+	if slugs != 1 {
+		return nil, fmt.Errorf("permalink %q must contain %s exactly once", pattern, permSlug)
+	}
+	return pl, nil
+}
+
+// segments returns the unescaped path segments of a post
+func (pl *permalink) segments(name string, date time.Time) []string {
+	segs := make([]string, len(pl.segs))
+	for i, s := range pl.segs {
+		switch s {
+		case permYear:
+			segs[i] = fmt.Sprintf("%04d", date.Year())
+		case permMonth:
+			segs[i] = fmt.Sprintf("%02d", int(date.Month()))
+		case permDay:
+			segs[i] = fmt.Sprintf("%02d", date.Day())
+		case permSlug:
+			segs[i] = name
+		default:
+			segs[i] = s
+		}
+	}
+	return segs
+}
+
+func (pl *permalink) join(segs []string) string {
+	p := "/" + strings.Join(segs, "/")
+	if pl.trailing {
+		p += "/"
+	}
+	return p
+}
+
+// match pulls the slug out of an unescaped path if it fits the pattern.  The
+// date segments found are returned so they can be checked against the post.
+func (pl *permalink) match(segs []string) (string, map[string]int, bool) {
+	if len(segs) != len(pl.segs) {
+		return "", nil, false
+	}
+	var slug string
+	date := map[string]int{}
+	for i, s := range pl.segs {
+		switch s {
+		case permSlug:
+			slug = segs[i]
+		case permYear, permMonth, permDay:
+			v, err := strconv.Atoi(segs[i])
+			if err != nil || v < 0 {
+				return "", nil, false
+			}
+			date[s] = v
+		default:
+			if segs[i] != s {
+				return "", nil, false
+			}
+		}
+	}
+	return slug, date, slug != ""
+}
+
+// postPath returns the site relative canonical path a post is served on
+func (b *blog) postPath(name string, date time.Time) string {
+	segs := b.permalinks.segments(name, date)
+	for i := range segs {
+		segs[i] = url.PathEscape(segs[i])
+	}
+	return b.permalinks.join(segs)
+}
+
+// pagePath returns the site relative path a static page is served on
+func pagePath(name string) string {
+	return "/" + url.PathEscape(name)
+}
+
+// routeRequest finds the static page or post a path names and renders it.
+// Anything reachable under a different path than its canonical one, such
+// as a post linked by name only or a path with the wrong trailing slash, is
+// permanently redirected to the canonical path.
+func (b *blog) routeRequest(rc *ResponseCapture, r *http.Request) error {
+	clean := path.Clean(r.URL.Path)
+	if slashRoutes[clean] {
+		redirectCanonical(rc, r, clean)
+		return nil
+	}
+	segs := strings.Split(strings.Trim(clean, "/"), "/")
+	if len(segs) == 1 {
+		bp, err := b.db.GetPage(segs[0])
+		if err != nil && err != errNotFound {
+			return err
+		} else if err == nil && bp.Published() {
+			if canon := "/" + segs[0]; r.URL.Path != canon {
+				redirectCanonical(rc, r, pagePath(segs[0]))
+				return nil
+			}
+			return b.getPage(rc, r, segs[0], bp)
+		}
+	}
+
+	slug, date, ok := b.permalinks.match(segs)
+	if !ok && len(segs) == 1 {
+		//posts linked by name alone predate the permalink pattern
+		slug = segs[0]
+	} else if !ok {
+		return b.serveRedirect(rc, r, clean)
+	}
+	bp, err := b.db.Get(slug)
+	if err != nil {
+		if err == errNotFound {
+			//aliases are stored by name so they follow permalink changes
+			return b.serveRedirect(rc, r, clean, "/"+slug)
+		}
+		return err
+	}
+	if !bp.Published() || !dateMatches(date, bp.Date) {
+		b.errorPage(rc, r, http.StatusNotFound)
+		return nil
+	}
+	if canon := b.permalinks.join(b.permalinks.segments(slug, bp.Date)); r.URL.Path != canon {
+		redirectCanonical(rc, r, b.postPath(slug, bp.Date))
+		return nil
+	}
+	return b.getUpdate(rc, r, slug, bp)
+}
+
+func dateMatches(date map[string]int, t time.Time) bool {
+	for k, v := range date {
+		switch k {
+		case permYear:
+			if v != t.Year() {
+				return false
+			}
+		case permMonth:
+			if v != int(t.Month()) {
+				return false
+			}
+		case permDay:
+			if v != t.Day() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// redirectCanonical sends a permanent redirect to p, keeping the query
+func redirectCanonical(w http.ResponseWriter, r *http.Request, p string) {
+	if r.URL.RawQuery != "" {
+		p += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, p, http.StatusMovedPermanently)
+}
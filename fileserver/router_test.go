@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+func TestParsePermalink(t *testing.T) {
+	for _, tc := range []struct {
+		pattern  string
+		segs     []string
+		trailing bool
+		bad      bool
+	}{
+		{pattern: "/:slug", segs: []string{":slug"}},
+		{pattern: "/:year/:month/:slug/", segs: []string{":year", ":month", ":slug"}, trailing: true},
+		{pattern: "/blog/:year/:month/:day/:slug", segs: []string{"blog", ":year", ":month", ":day", ":slug"}},
+		{pattern: ":slug", bad: true},
+		{pattern: "/:year/:month", bad: true},
+		{pattern: "/:slug/:slug", bad: true},
+		{pattern: "/:hour/:slug", bad: true},
+		{pattern: "/a//:slug", bad: true},
+	} {
+		pl, err := parsePermalink(tc.pattern)
+		if tc.bad {
+			if err == nil {
+				t.Errorf("%q parsed", tc.pattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.pattern, err)
+		} else if !reflect.DeepEqual(pl.segs, tc.segs) || pl.trailing != tc.trailing {
+			t.Errorf("%q parsed to %q trailing %v", tc.pattern, pl.segs, pl.trailing)
+		}
+	}
+}
+
+func TestPermalinkMatch(t *testing.T) {
+	pl, err := parsePermalink("/blog/:year/:month/:slug/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2021, 3, 9, 0, 0, 0, 0, time.UTC)
+	if p := pl.join(pl.segments("hello", date)); p != "/blog/2021/03/hello/" {
+		t.Fatalf("post path %q", p)
+	}
+	for _, tc := range []struct {
+		segs []string
+		slug string
+		date map[string]int
+		ok   bool
+	}{
+		{[]string{"blog", "2021", "03", "hello"}, "hello", map[string]int{permYear: 2021, permMonth: 3}, true},
+		{[]string{"blog", "2021", "3", "hello"}, "hello", map[string]int{permYear: 2021, permMonth: 3}, true},
+		{[]string{"news", "2021", "03", "hello"}, "", nil, false},
+		{[]string{"blog", "2021", "march", "hello"}, "", nil, false},
+		{[]string{"blog", "2021", "-3", "hello"}, "", nil, false},
+		{[]string{"blog", "2021", "03"}, "", nil, false},
+		{[]string{"blog", "2021", "03", ""}, "", nil, false},
+	} {
+		slug, d, ok := pl.match(tc.segs)
+		if slug != tc.slug || ok != tc.ok || (ok && !reflect.DeepEqual(d, tc.date)) {
+			t.Errorf("%q matched %q %v %v", tc.segs, slug, d, ok)
+		}
+	}
+}
+
+func TestRouteRequest(t *testing.T) {
+	b := testBlog(t)
+	if err := b.loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	if b.permalinks, _ = parsePermalink("/:year/:month/:slug/"); b.permalinks == nil {
+		t.Fatal("bad permalink")
+	}
+	addTestPost(t, b, "hello", 0, blogpost.BlogPost{Aliases: []string{"hi", "/old/path"}})
+	if err := b.db.AddPage("about", &blogpost.BlogPost{Title: "About", Kind: blogpost.KindPage}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.db.ImportRedirects(map[string]redirect{
+		"/feed":    {Target: "/feed.xml", Code: http.StatusFound},
+		"/dropped": {Code: http.StatusGone},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path     string
+		code     int
+		location string
+	}{
+		//canonical paths are served
+		{"/2020/01/hello/", http.StatusOK, ""},
+		{"/about", http.StatusOK, ""},
+		//everything else that names them redirects to the canonical path
+		{"/2020/01/hello", http.StatusMovedPermanently, "/2020/01/hello/"},
+		{"/2020/1/hello/", http.StatusMovedPermanently, "/2020/01/hello/"},
+		{"/hello", http.StatusMovedPermanently, "/2020/01/hello/"},
+		{"/hello?x=1", http.StatusMovedPermanently, "/2020/01/hello/?x=1"},
+		{"/about/", http.StatusMovedPermanently, "/about"},
+		{"/archive/", http.StatusMovedPermanently, "/archive"},
+		{"/search/?q=go", http.StatusMovedPermanently, "/search?q=go"},
+		//the date has to be the post's
+		{"/2020/02/hello/", http.StatusNotFound, ""},
+		//aliases follow the post, imported redirects keep their target
+		{"/hi", http.StatusMovedPermanently, "/2020/01/hello/"},
+		{"/old/path", http.StatusMovedPermanently, "/2020/01/hello/"},
+		{"/feed", http.StatusFound, "/feed.xml"},
+		{"/dropped", http.StatusGone, ""},
+		{"/nope", http.StatusNotFound, ""},
+	} {
+		rec := httptest.NewRecorder()
+		b.templateHandler(rec, httptest.NewRequest("GET", tc.path, nil))
+		if rec.Code != tc.code || rec.Header().Get("Location") != tc.location {
+			t.Errorf("%s: got %d %q, wanted %d %q", tc.path, rec.Code, rec.Header().Get("Location"), tc.code, tc.location)
+		}
+	}
+}
+
+func TestDeletePostAliases(t *testing.T) {
+	b := testBlog(t)
+	if err := b.loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	addTestPost(t, b, "hello", 0, blogpost.BlogPost{Aliases: []string{"hi"}})
+	if err := b.db.Delete("hello"); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	b.templateHandler(rec, httptest.NewRequest("GET", "/hi", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("alias of a deleted post: %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if _, err := b.db.Redirect("/hi"); err != errNotFound {
+		t.Fatalf("alias still stored: %v", err)
+	}
+	//the alias is free for another post
+	if ue := b.checkUpdate("other", &blogpost.BlogPost{Title: "Other", Aliases: []string{"hi"}}); ue != nil {
+		t.Fatalf("alias still reserved: %v", ue)
+	}
+}
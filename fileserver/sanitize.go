@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/traetox/blogEngine/blogpost"
+	"golang.org/x/net/html"
+)
+
+const (
+	policyUGC    = `ugc`
+	policyStrict = `strict`
+	policyNone   = `none`
+)
+
+var (
+	sanitizer     *bluemonday.Policy
+	sanitizerName string
+)
+
+// SetSanitizePolicy selects the policy post content is run through before
+// it is handed to the templates as trusted HTML.  The ugc policy allows the
+// usual formatting, links, images, tables and styling classes, strict strips
+// all markup, and none trusts post content as is.
+func SetSanitizePolicy(name string) error {
+	switch name {
+	case policyUGC:
+		p := bluemonday.UGCPolicy()
+		p.AllowStyling()
+		p.RequireNoFollowOnLinks(false)
+		sanitizer = p
+	case policyStrict:
+		sanitizer = bluemonday.StrictPolicy()
+	case policyNone:
+		sanitizer = nil
+	default:
+		return fmt.Errorf("unknown sanitizer policy %q", name)
+	}
+	sanitizerName = name
+	return nil
+}
+
+// sanitizeContent runs post HTML through the configured policy, the result
+// is the only post content that is ever marked as trusted
+func sanitizeContent(s string) template.HTML {
+	if sanitizer == nil {
+		return template.HTML(s)
+	}
+	return template.HTML(sanitizer.Sanitize(s))
+}
+
+// sanitizeAlters returns true if the sanitizer would change the meaning of
+// s.  Both versions are tokenized and re-rendered first so differences in
+// quoting or entity encoding alone are not reported.
+func sanitizeAlters(s string) bool {
+	if sanitizer == nil {
+		return false
+	}
+	return normalizeHTML(s) != normalizeHTML(sanitizer.Sanitize(s))
+}
+
+func normalizeHTML(s string) string {
+	var sb strings.Builder
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return sb.String()
+		}
+		tok := z.Token()
+		if tt == html.TextToken {
+			if txt := strings.Join(strings.Fields(tok.Data), " "); txt != "" {
+				sb.WriteString(html.EscapeString(txt))
+			}
+			continue
+		}
+		sort.Slice(tok.Attr, func(i, j int) bool { return tok.Attr[i].Key < tok.Attr[j].Key })
+		if tt == html.SelfClosingTagToken {
+			tok.Type = html.StartTagToken
+		}
+		sb.WriteString(tok.String())
+	}
+}
+
+// checkPostHTML writes a warning for every post whose HTML the sanitizer
+// would alter and returns how many were flagged
+func (b *blog) checkPostHTML(w io.Writer) (int, error) {
+	if sanitizer == nil {
+		return 0, nil
+	}
+	items, err := b.filterPosts(func(bp *blogpost.BlogPost) bool { return true }, 0)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, it := range items {
+		if sanitizeAlters(it.bp.Content) {
+			fmt.Fprintf(w, "WARNING: the %s sanitizer policy alters the HTML of post %q\n", sanitizerName, it.name)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// runCheckHTML is the check-html command, it reports posts that will render
+// differently under the configured policy
+func (b *blog) runCheckHTML() (int, error) {
+	if err := b.openDB(0); err != nil {
+		return 0, err
+	}
+	defer b.closeDB()
+	n, err := b.checkPostHTML(os.Stdout)
+	if err != nil {
+		return 0, err
+	}
+	fmt.Printf("%d posts altered by the %s sanitizer policy\n", n, sanitizerName)
+	return n, nil
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+const (
+	searchIndexId = `searchindex`
+	searchDocsId  = `searchdocs`
+
+	titleWeight   = 5
+	tagWeight     = 3
+	contentWeight = 1
+
+	maxSearchResults = 25
+	snippetBefore    = 12
+	snippetAfter     = 24
+)
+
+var (
+	searchIndexBkt = []byte(searchIndexId)
+	searchDocsBkt  = []byte(searchDocsId)
+
+	stopWords = map[string]bool{}
+)
+
+func init() {
+	for _, w := range strings.Fields(`a about above after again against all am an and any are as at be
+		because been before being below between both but by can could did do does doing down during
+		each few for from further had has have having he her here hers herself him himself his how i
+		if in into is it its itself just me more most my myself no nor not now of off on once only or
+		other our ours ourselves out over own same she should so some such than that the their theirs
+		them themselves then there these they this those through to too under until up very was we
+		were what when where which while who whom why will with would you your yours yourself`) {
+		stopWords[w] = true
+	}
+}
+
+// postings maps post names to the weighted frequency of a term in that post
+type postings map[string]uint32
+
+type searchHit struct {
+	Name    string        `json:"name"`
+	Title   string        `json:"title"`
+	URL     string        `json:"url"`
+	Date    time.Time     `json:"date"`
+	Score   float64       `json:"score"`
+	Snippet template.HTML `json:"snippet"`
+}
+
+type searchResults struct {
+	Query   string      `json:"query"`
+	Results []searchHit `json:"results"`
+}
+
+// tokenize splits text into lower case words on anything that is not a
+// letter or a digit
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// indexTerms reduces text to the stemmed terms that go into the index
+func indexTerms(s string) []string {
+	var terms []string
+	for _, w := range tokenize(s) {
+		if len(w) < 2 || stopWords[w] {
+			continue
+		}
+		terms = append(terms, stem(w))
+	}
+	return terms
+}
+
+// stem is a trimmed down Porter stemmer covering plurals, past and
+// progressive forms and the common derivational suffixes.  It only has to be
+// consistent between indexing and querying, not linguistically perfect.
+func stem(w string) string {
+	if len(w) <= 3 {
+		return w
+	}
+	switch {
+	case strings.HasSuffix(w, "sses"), strings.HasSuffix(w, "ies"):
+		w = w[:len(w)-2]
+	case strings.HasSuffix(w, "ss"), strings.HasSuffix(w, "us"):
+	case strings.HasSuffix(w, "s"):
+		w = w[:len(w)-1]
+	}
+	for _, sfx := range []string{"ingly", "edly", "ing", "ed"} {
+		if !strings.HasSuffix(w, sfx) || !hasVowel(w[:len(w)-len(sfx)]) {
+			continue
+		}
+		w = w[:len(w)-len(sfx)]
+		if n := len(w); n > 2 && w[n-1] == w[n-2] && !strings.ContainsRune("aeioulsz", rune(w[n-1])) {
+			w = w[:n-1]
+		}
+		break
+	}
+	if n := len(w); n > 2 && w[n-1] == 'y' && hasVowel(w[:n-1]) {
+		w = w[:n-1] + "i"
+	}
+	for _, r := range [][2]string{
+		{"ational", "ate"}, {"tional", "tion"}, {"ization", "ize"}, {"ation", "ate"},
+		{"iveness", "ive"}, {"fulness", "ful"}, {"ousness", "ous"}, {"alism", "al"},
+		{"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"}, {"ment", ""}, {"ness", ""},
+	} {
+		if strings.HasSuffix(w, r[0]) && len(w)-len(r[0]) >= 3 {
+			w = w[:len(w)-len(r[0])] + r[1]
+			break
+		}
+	}
+	return w
+}
+
+func hasVowel(s string) bool {
+	return strings.ContainsAny(s, "aeiouy")
+}
+
+// postTermWeights generates the weighted term frequencies for a post
+func postTermWeights(bp *blogpost.BlogPost) map[string]uint32 {
+	tw := map[string]uint32{}
+	for _, t := range indexTerms(bp.Title) {
+		tw[t] += titleWeight
+	}
+	for _, t := range indexTerms(strings.Join(bp.Tags, " ")) {
+		tw[t] += tagWeight
+	}
+	for _, t := range indexTerms(contentText(bp)) {
+		tw[t] += contentWeight
+	}
+	return tw
+}
+
+// indexPost replaces any existing index entries for name with those for bp,
+// it must be called inside the same transaction that stores the post
+func indexPost(tx *bolt.Tx, name string, bp *blogpost.BlogPost) error {
+	if err := unindexPost(tx, name); err != nil {
+		return err
+	}
+	tw := postTermWeights(bp)
+	terms := make([]string, 0, len(tw))
+	for t, w := range tw {
+		p, err := getPostings(tx, t)
+		if err != nil {
+			return err
+		}
+		p[name] = w
+		if err := putPostings(tx, t, p); err != nil {
+			return err
+		}
+		terms = append(terms, t)
+	}
+	buff, err := gobEncode(terms)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(searchDocsBkt).Put([]byte(name), buff)
+}
+
+// unindexPost removes a post from the postings of every term it was indexed
+// under
+func unindexPost(tx *bolt.Tx, name string) error {
+	docs := tx.Bucket(searchDocsBkt)
+	v := docs.Get([]byte(name))
+	if v == nil {
+		return nil
+	}
+	var terms []string
+	if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&terms); err != nil {
+		return err
+	}
+	for _, t := range terms {
+		p, err := getPostings(tx, t)
+		if err != nil {
+			return err
+		}
+		delete(p, name)
+		if err := putPostings(tx, t, p); err != nil {
+			return err
+		}
+	}
+	return docs.Delete([]byte(name))
+}
+
+func getPostings(tx *bolt.Tx, term string) (postings, error) {
+	p := postings{}
+	v := tx.Bucket(searchIndexBkt).Get([]byte(term))
+	if v == nil {
+		return p, nil
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func putPostings(tx *bolt.Tx, term string, p postings) error {
+	bkt := tx.Bucket(searchIndexBkt)
+	if len(p) == 0 {
+		return bkt.Delete([]byte(term))
+	}
+	buff, err := gobEncode(p)
+	if err != nil {
+		return err
+	}
+	return bkt.Put([]byte(term), buff)
+}
+
+func gobEncode(v interface{}) ([]byte, error) {
+	bb := bytes.NewBuffer(nil)
+	if err := gob.NewEncoder(bb).Encode(v); err != nil {
+		return nil, err
+	}
+	return bb.Bytes(), nil
+}
+
+// nlEnsureIndex indexes any cached post that is missing from the search
+// index, which brings databases created before search existed up to date
+func (db *boltDB) nlEnsureIndex() error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		docs := tx.Bucket(searchDocsBkt)
+		for name, bp := range db.cache {
+			if docs.Get([]byte(name)) != nil {
+				continue
+			}
+			if err := indexPost(tx, name, bp); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Search ranks published posts against the query using tf-idf over the
+// weighted term frequencies.  Posts matching more of the query terms rank
+// higher, posts matching none are not returned.
+func (db *boltDB) Search(query string) ([]searchHit, error) {
+	terms := indexTerms(query)
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.db == nil {
+		return nil, errNotOpen
+	}
+	scores := map[string]float64{}
+	total := float64(len(db.cache))
+	if err := db.db.View(func(tx *bolt.Tx) error {
+		for _, t := range terms {
+			p, err := getPostings(tx, t)
+			if err != nil {
+				return err
+			}
+			idf := math.Log(1 + total/float64(1+len(p)))
+			for name, w := range p {
+				scores[name] += float64(w) * idf
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	var hits []searchHit
+	for name, score := range scores {
+		bp, ok := db.cache[name]
+		if !ok || !bp.Published() {
+			continue
+		}
+		hits = append(hits, searchHit{
+			Name:    name,
+			Title:   bp.Title,
+			Date:    bp.Date,
+			Score:   score,
+			Snippet: snippet(contentText(bp), terms),
+		})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score == hits[j].Score {
+			return hits[i].Date.After(hits[j].Date)
+		}
+		return hits[i].Score > hits[j].Score
+	})
+	if len(hits) > maxSearchResults {
+		hits = hits[:maxSearchResults]
+	}
+	return hits, nil
+}
+
+// snippet returns an escaped HTML excerpt of text around the first word
+// matching one of the stemmed terms with every matching word wrapped in mark.
+// Every word is escaped so the result is safe to mark as trusted HTML.
+func snippet(text string, terms []string) template.HTML {
+	want := map[string]bool{}
+	for _, t := range terms {
+		want[t] = true
+	}
+	words := strings.Fields(text)
+	first := -1
+	for i, w := range words {
+		if matchesTerm(w, want) {
+			first = i
+			break
+		}
+	}
+	start, end := 0, len(words)
+	if first > snippetBefore {
+		start = first - snippetBefore
+	}
+	if start+snippetBefore+snippetAfter < end {
+		end = start + snippetBefore + snippetAfter
+	}
+	bb := bytes.NewBuffer(nil)
+	if start > 0 {
+		bb.WriteString("&hellip; ")
+	}
+	for i := start; i < end; i++ {
+		if i > start {
+			bb.WriteByte(' ')
+		}
+		if matchesTerm(words[i], want) {
+			fmt.Fprintf(bb, "<mark>%s</mark>", html.EscapeString(words[i]))
+		} else {
+			bb.WriteString(html.EscapeString(words[i]))
+		}
+	}
+	if end < len(words) {
+		bb.WriteString(" &hellip;")
+	}
+	return template.HTML(bb.String())
+}
+
+func matchesTerm(word string, want map[string]bool) bool {
+	for _, w := range tokenize(word) {
+		if want[stem(w)] {
+			return true
+		}
+	}
+	return false
+}
+
+// search runs a query against the post DB and links each hit to its post
+func (b *blog) search(q string) ([]searchHit, error) {
+	hits, err := b.db.Search(q)
+	if err != nil {
+		return nil, err
+	}
+	for i := range hits {
+		hits[i].URL = b.postPath(hits[i].Name, hits[i].Date)
+	}
+	return hits, nil
+}
+
+func (b *blog) searchHandler(w http.ResponseWriter, r *http.Request) {
+	rc := NewResponseCapture(w)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		rc.Header().Set("Allow", "GET, HEAD")
+		b.errorPage(rc, r, http.StatusMethodNotAllowed)
+	} else if err := b.getSearch(rc, r, r.URL.Query().Get("q")); err != nil {
+		b.serverError(rc, r, err)
+	}
+	//always log the request
+	b.logRequest(r, rc.Code())
+}
+
+func (b *blog) searchJSONHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		apiWriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query().Get("q")
+	res := searchResults{
+		Query:   q,
+		Results: []searchHit{},
+	}
+	if q != "" {
+		hits, err := b.search(q)
+		if err != nil {
+			apiWriteError(w, http.StatusInternalServerError, "search failed")
+			return
+		}
+		if hits != nil {
+			res.Results = hits
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (b *blog) getSearch(rc *ResponseCapture, r *http.Request, q string) error {
+	pd := b.newPageData(pageSearch, blogpost.BlogPost{
+		Title: "Search",
+	})
+	pd.Query = q
+	if q != "" {
+		hits, err := b.search(q)
+		if err != nil {
+			return err
+		}
+		pd.Results = hits
+	}
+	//results carry no single modification time, the ETag alone validates them
+	return b.servePage(rc, r, pd, time.Time{})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+func TestTokenize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{"Hello, World!", []string{"hello", "world"}},
+		{"Go1.21 is out", []string{"go1", "21", "is", "out"}},
+		{"naïve café", []string{"naïve", "café"}},
+		{"  --  ", []string{}},
+	} {
+		if got := tokenize(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("tokenize(%q) = %q, wanted %q", tc.in, got, tc.want)
+		}
+	}
+	//stop words and single letters never reach the index
+	if got := indexTerms("The cats and a dog x"); !reflect.DeepEqual(got, []string{"cat", "dog"}) {
+		t.Errorf("index terms %q", got)
+	}
+}
+
+func TestStem(t *testing.T) {
+	for in, want := range map[string]string{
+		"go":         "go",
+		"bus":        "bus",
+		"cats":       "cat",
+		"ponies":     "poni",
+		"caresses":   "caress",
+		"status":     "status",
+		"running":    "run",
+		"hopped":     "hop",
+		"sing":       "sing",
+		"happy":      "happi",
+		"happiness":  "happi",
+		"relational": "relate",
+		"movement":   "move",
+	} {
+		if got := stem(in); got != want {
+			t.Errorf("stem(%q) = %q, wanted %q", in, got, want)
+		}
+	}
+}
+
+func TestSearchIndexUpdates(t *testing.T) {
+	b := testBlog(t)
+	names := func(q string) []string {
+		hits, err := b.db.Search(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ns []string
+		for _, h := range hits {
+			ns = append(ns, h.Name)
+		}
+		return ns
+	}
+	indexed := func(term string) bool {
+		var n int
+		if err := b.db.db.View(func(tx *bolt.Tx) error {
+			p, err := getPostings(tx, term)
+			n = len(p)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n > 0
+	}
+
+	addTestPost(t, b, "a", 0, blogpost.BlogPost{Content: "<p>gophers burrowing</p>"})
+	if got := names("gopher"); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("search after add %q", got)
+	}
+	//replacing a post drops the terms it no longer has
+	addTestPost(t, b, "a", 0, blogpost.BlogPost{Content: "<p>ferrets</p>"})
+	if got := names("gopher"); got != nil || indexed("gopher") {
+		t.Fatalf("old terms still indexed: %q", got)
+	}
+	if got := names("ferret"); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("search after replace %q", got)
+	}
+	if err := b.db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := names("ferret"); got != nil || indexed("ferret") {
+		t.Fatalf("deleted post still indexed: %q", got)
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	b := testBlog(t)
+	addTestPost(t, b, "content", 0, blogpost.BlogPost{Content: "a note about gophers"})
+	addTestPost(t, b, "title", 1, blogpost.BlogPost{Title: "Gophers", Content: "nothing else"})
+	addTestPost(t, b, "tagged", 2, blogpost.BlogPost{Tags: []string{"gopher"}, Content: "tagged only"})
+	addTestPost(t, b, "both", 3, blogpost.BlogPost{Content: "gophers and ferrets"})
+	draft := &blogpost.BlogPost{Title: "Gophers", Status: blogpost.StatusDraft, Date: time.Now()}
+	if err := b.db.Add("draft", draft); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		q    string
+		want []string
+	}{
+		//title beats tags beats content, newer first on a tie
+		{"gopher", []string{"title", "tagged", "both", "content"}},
+		//matching more of the query lifts a content match past a tag match
+		{"gopher ferret", []string{"title", "both", "tagged", "content"}},
+		{"the and", nil},
+	} {
+		hits, err := b.db.Search(tc.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, h := range hits {
+			got = append(got, h.Name)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q ranked %q, wanted %q", tc.q, got, tc.want)
+		}
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	long := strings.Repeat("filler ", 20) + "the <b>gophers</b> dig " + strings.Repeat("more ", 40)
+	for _, tc := range []struct {
+		text  string
+		terms []string
+		want  []string
+		not   []string
+	}{
+		{"Gophers dig.", []string{"gopher"}, []string{"<mark>Gophers</mark> dig."}, []string{"&hellip;"}},
+		{"a <script> tag", []string{"script"}, []string{"<mark>&lt;script&gt;</mark>"}, []string{"<script>"}},
+		{long, []string{"gopher"}, []string{"&hellip; filler", "<mark>&lt;b&gt;gophers&lt;/b&gt;</mark>", "more &hellip;"}, nil},
+		{"no match here", []string{"gopher"}, []string{"no match here"}, []string{"<mark>"}},
+	} {
+		got := string(snippet(tc.text, tc.terms))
+		for _, w := range tc.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("snippet %q is missing %q", got, w)
+			}
+		}
+		for _, n := range tc.not {
+			if strings.Contains(got, n) {
+				t.Errorf("snippet %q contains %q", got, n)
+			}
+		}
+	}
+}
+
+func TestSearchSanitizedContent(t *testing.T) {
+	b := testBlog(t)
+	addTestPost(t, b, "a", 0, blogpost.BlogPost{
+		Content: `<p>gophers</p><script>stealcookies()</script><style>.hidden{}</style><iframe>framed</iframe>`,
+	})
+	for _, q := range []string{"stealcookies", "hidden", "framed"} {
+		if hits, err := b.db.Search(q); err != nil || len(hits) != 0 {
+			t.Fatalf("%q found %+v: %v", q, hits, err)
+		}
+	}
+	hits, err := b.db.Search("gophers")
+	if err != nil || len(hits) != 1 {
+		t.Fatalf("search gave %+v: %v", hits, err)
+	}
+	if s := string(hits[0].Snippet); strings.Contains(s, "stealcookies") || strings.Contains(s, "hidden") {
+		t.Fatalf("snippet shows dropped markup: %q", s)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	cspReportPath = `/csp-report`
+	routeSection  = `headers`
+
+	//largest violation report read
+	maxCSPReport = 64 << 10
+	//violations a blog logs per minute and at once, the rest are counted
+	cspLogRate  = 10
+	cspLogBurst = 20
+	//longest violation logged
+	maxCSPLogLine = 512
+)
+
+var (
+	//security headers for [headers."/prefix"] sections of the config file
+	headerRoutes []*routeHeaders
+
+	//settings a headers section takes and the header setting each one fills
+	routeKeys = map[string]func(rh *routeHeaders, v string) error{
+		"csp":                func(rh *routeHeaders, v string) error { rh.csp = v; return nil },
+		"csp_report_only":    func(rh *routeHeaders, v string) (err error) { rh.cspReportOnly, err = strconv.ParseBool(v); return },
+		"frame_ancestors":    func(rh *routeHeaders, v string) error { rh.frameAncestors = v; return nil },
+		"referrer_policy":    func(rh *routeHeaders, v string) error { rh.referrerPolicy = v; return nil },
+		"permissions_policy": func(rh *routeHeaders, v string) error { rh.permissionsPolicy = v; return nil },
+	}
+
+	errBadCSPReport = errors.New("not a CSP violation report")
+
+	//violation reports dropped from the log, served with the other expvars
+	cspReportsDropped = expvar.NewInt("csp_reports_dropped")
+
+	//rendered pages carry this in place of the nonce until they are served,
+	//it is random so post content can not smuggle one in
+	noncePlaceholder = newNonce()
+)
+
+type nonceKey struct{}
+
+// routeHeaders are the security headers sent on responses under a path
+// prefix.  The CSP gets a nonce source for inline scripts added to its
+// script-src, or to a script-src copied from default-src, and a report-uri.
+type routeHeaders struct {
+	prefix            string
+	csp               string
+	cspReportOnly     bool
+	frameAncestors    string
+	referrerPolicy    string
+	permissionsPolicy string
+}
+
+// defaultRouteHeaders returns the headers configured by the top level settings
+func defaultRouteHeaders() *routeHeaders {
+	return &routeHeaders{
+		prefix:            "/",
+		csp:               *cspPolicy,
+		cspReportOnly:     *cspReportOnly,
+		frameAncestors:    *frameAncestors,
+		referrerPolicy:    *referrerPolicy,
+		permissionsPolicy: *permissionsPolicy,
+	}
+}
+
+// newRouteHeaders builds the per route headers from the values of their
+// config file sections, anything a section leaves out is taken from the
+// top level settings
+func newRouteHeaders(file string, vals []configValue) ([]*routeHeaders, error) {
+	var rhs []*routeHeaders
+	byPrefix := map[string]*routeHeaders{}
+	for _, v := range vals {
+		if v.section != routeSection {
+			continue
+		}
+		rh, ok := byPrefix[v.name]
+		if !ok {
+			rh = defaultRouteHeaders()
+			rh.prefix = v.name
+			byPrefix[v.name] = rh
+			rhs = append(rhs, rh)
+		}
+		if err := routeKeys[v.setting](rh, v.value); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", file, v.key, err)
+		}
+	}
+	return rhs, nil
+}
+
+// validateRouteHeaders checks the top level and per route headers
+func validateRouteHeaders() []string {
+	var ce []string
+	for _, rh := range append([]*routeHeaders{defaultRouteHeaders()}, headerRoutes...) {
+		if !strings.HasPrefix(rh.prefix, "/") {
+			ce = append(ce, fmt.Sprintf("headers route %q must be a path starting with /", rh.prefix))
+		}
+		if strings.ContainsAny(rh.csp+rh.frameAncestors+rh.referrerPolicy+rh.permissionsPolicy, "\r\n") {
+			ce = append(ce, fmt.Sprintf("headers for %s can not contain line breaks", rh.prefix))
+		}
+		if strings.Contains(strings.ToLower(rh.csp), "frame-ancestors") {
+			ce = append(ce, fmt.Sprintf("headers for %s: set frame-ancestors with its own setting, not in the CSP", rh.prefix))
+		}
+	}
+	return ce
+}
+
+// policy returns the CSP carrying nonce
+func (rh *routeHeaders) policy(nonce string) string {
+	var dirs []string
+	var defaultSrc string
+	var scriptSrc bool
+	src := "'nonce-" + nonce + "'"
+	for _, d := range strings.Split(rh.csp, ";") {
+		fields := strings.Fields(d)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToLower(fields[0]) {
+		case "default-src":
+			defaultSrc = strings.Join(fields[1:], " ")
+		case "script-src":
+			scriptSrc = true
+			fields = append(withoutNone(fields), src)
+		}
+		dirs = append(dirs, strings.Join(fields, " "))
+	}
+	if !scriptSrc && defaultSrc != "" {
+		dirs = append(dirs, strings.Join(append(withoutNone(append([]string{"script-src"}, strings.Fields(defaultSrc)...)), src), " "))
+	}
+	if rh.frameAncestors != "" {
+		dirs = append(dirs, "frame-ancestors "+rh.frameAncestors)
+	}
+	dirs = append(dirs, "report-uri "+cspReportPath)
+	return strings.Join(dirs, "; ")
+}
+
+// withoutNone drops a 'none' source, which can not be combined with a nonce
+func withoutNone(fields []string) []string {
+	out := fields[:0:0]
+	for _, f := range fields {
+		if !strings.EqualFold(f, "'none'") {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func (rh *routeHeaders) cspHeader() string {
+	if rh.cspReportOnly {
+		return "Content-Security-Policy-Report-Only"
+	}
+	return "Content-Security-Policy"
+}
+
+// setHeaders adds the headers to a response.  Older browsers that ignore
+// frame-ancestors get an X-Frame-Options when there is one that matches.
+func (rh *routeHeaders) setHeaders(hdr http.Header, nonce string) {
+	hdr.Set("X-Content-Type-Options", "nosniff")
+	if rh.referrerPolicy != "" {
+		hdr.Set("Referrer-Policy", rh.referrerPolicy)
+	}
+	if rh.permissionsPolicy != "" {
+		hdr.Set("Permissions-Policy", rh.permissionsPolicy)
+	}
+	switch strings.ToLower(rh.frameAncestors) {
+	case "'none'":
+		hdr.Set("X-Frame-Options", "DENY")
+	case "'self'":
+		hdr.Set("X-Frame-Options", "SAMEORIGIN")
+	}
+	if rh.csp != "" {
+		hdr.Set(rh.cspHeader(), rh.policy(nonce))
+	}
+}
+
+// securityHandler adds the security headers of the longest matching route to
+// every response.  Each request gets a fresh CSP nonce which pages write into
+// their inline scripts as they are served.
+func securityHandler(h http.Handler, routes []*routeHeaders) http.Handler {
+	def := defaultRouteHeaders()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rh := def
+		for _, rt := range routes {
+			if strings.HasPrefix(r.URL.Path, rt.prefix) && len(rt.prefix) > len(rh.prefix) {
+				rh = rt
+			}
+		}
+		var nonce string
+		if rh.csp != "" {
+			nonce = newNonce()
+			r = r.WithContext(context.WithValue(r.Context(), nonceKey{}, nonce))
+		}
+		rh.setHeaders(w.Header(), nonce)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// requestNonce returns the CSP nonce of a request, empty if there is no CSP
+func requestNonce(r *http.Request) string {
+	n, _ := r.Context().Value(nonceKey{}).(string)
+	return n
+}
+
+// withRequestNonce swaps the nonce placeholder in a rendered page for the
+// nonce of the request it is served to
+func withRequestNonce(r *http.Request, page []byte) []byte {
+	return bytes.Replace(page, []byte(noncePlaceholder), []byte(requestNonce(r)), -1)
+}
+
+// keepPolicyWriter drops the CSP from a 304 response.  The client keeps the
+// page it already has, and with it the policy carrying that page's nonce.
+type keepPolicyWriter struct {
+	http.ResponseWriter
+}
+
+func (kw *keepPolicyWriter) WriteHeader(code int) {
+	if code == http.StatusNotModified {
+		kw.Header().Del("Content-Security-Policy")
+		kw.Header().Del("Content-Security-Policy-Report-Only")
+	}
+	kw.ResponseWriter.WriteHeader(code)
+}
+
+// cspViolation holds the fields of a violation report worth logging, as
+// sent to report-uri or through the Reporting API
+type cspViolation struct {
+	DocumentURI        string `json:"document-uri"`
+	ViolatedDirective  string `json:"violated-directive"`
+	EffectiveDirective string `json:"effective-directive"`
+	BlockedURI         string `json:"blocked-uri"`
+	SourceFile         string `json:"source-file"`
+	LineNumber         int    `json:"line-number"`
+
+	DocumentURL string `json:"documentURL"`
+	Directive   string `json:"effectiveDirective"`
+	BlockedURL  string `json:"blockedURL"`
+	SourceURL   string `json:"sourceFile"`
+	Line        int    `json:"lineNumber"`
+}
+
+func (cv cspViolation) String() string {
+	doc, dir, blocked, src, line := cv.DocumentURI, cv.EffectiveDirective, cv.BlockedURI, cv.SourceFile, cv.LineNumber
+	if doc == "" {
+		doc, dir, blocked, src, line = cv.DocumentURL, cv.Directive, cv.BlockedURL, cv.SourceURL, cv.Line
+	}
+	if dir == "" {
+		dir = cv.ViolatedDirective
+	}
+	s := fmt.Sprintf("%q violated %q blocking %q", doc, dir, blocked)
+	if src != "" {
+		s += fmt.Sprintf(" at %q:%d", src, line)
+	}
+	return s
+}
+
+// parseCSPReports reads the violations out of a report-uri or Reporting API
+// request body
+func parseCSPReports(body []byte) ([]cspViolation, error) {
+	body = bytes.TrimSpace(body)
+	if bytes.HasPrefix(body, []byte("[")) {
+		var reports []struct {
+			Type string       `json:"type"`
+			Body cspViolation `json:"body"`
+		}
+		if err := json.Unmarshal(body, &reports); err != nil {
+			return nil, err
+		}
+		var cvs []cspViolation
+		for _, r := range reports {
+			if r.Type == "csp-violation" {
+				cvs = append(cvs, r.Body)
+			}
+		}
+		return cvs, nil
+	}
+	var report struct {
+		Report *cspViolation `json:"csp-report"`
+	}
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, err
+	}
+	if report.Report == nil {
+		return nil, errBadCSPReport
+	}
+	return []cspViolation{*report.Report}, nil
+}
+
+// cspLimiter keeps violation reports from flooding the log, anything can
+// post them
+type cspLimiter struct {
+	mtx sync.Mutex
+	tb  tokenBucket
+}
+
+func (cl *cspLimiter) allow() bool {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	ok, _ := cl.tb.take(time.Now(), cspLogRate/60.0, cspLogBurst)
+	return ok
+}
+
+// truncateLine cuts s to at most n bytes on a character boundary
+func truncateLine(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "..."
+}
+
+// cspReportHandler logs the policy violations browsers report, up to the
+// rate the blog's limiter allows
+func (b *blog) cspReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		b.errorPage(w, r, http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxCSPReport))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	cvs, err := parseCSPReports(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, cv := range cvs {
+		if !b.cspLog.allow() {
+			cspReportsDropped.Add(1)
+			continue
+		}
+		fmt.Printf("CSP violation on %s: %s\n", r.Host, truncateLine(cv.String(), maxCSPLogLine))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		csp            string
+		frameAncestors string
+		want           string
+	}{
+		{
+			csp:  "default-src 'self'",
+			want: "default-src 'self'; script-src 'self' 'nonce-N'; report-uri /csp-report",
+		},
+		{
+			csp:  "default-src 'self'; script-src 'self' https://cdn.example",
+			want: "default-src 'self'; script-src 'self' https://cdn.example 'nonce-N'; report-uri /csp-report",
+		},
+		{
+			csp:  "default-src 'none'; img-src *",
+			want: "default-src 'none'; img-src *; script-src 'nonce-N'; report-uri /csp-report",
+		},
+		{
+			csp:  "  Script-Src 'NONE' ;; style-src 'self'  ",
+			want: "Script-Src 'nonce-N'; style-src 'self'; report-uri /csp-report",
+		},
+		{
+			csp:            "img-src 'self'",
+			frameAncestors: "'none'",
+			want:           "img-src 'self'; frame-ancestors 'none'; report-uri /csp-report",
+		},
+	} {
+		rh := &routeHeaders{prefix: "/", csp: tc.csp, frameAncestors: tc.frameAncestors}
+		if got := rh.policy("N"); got != tc.want {
+			t.Errorf("%q:\n got %q\nwant %q", tc.csp, got, tc.want)
+		}
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		rh      routeHeaders
+		csp     string
+		framing string
+	}{
+		{routeHeaders{csp: "default-src 'self'", frameAncestors: "'none'"}, "Content-Security-Policy", "DENY"},
+		{routeHeaders{csp: "default-src 'self'", cspReportOnly: true, frameAncestors: "'self'"}, "Content-Security-Policy-Report-Only", "SAMEORIGIN"},
+		{routeHeaders{frameAncestors: "https://a.example"}, "", ""},
+	} {
+		hdr := http.Header{}
+		tc.rh.setHeaders(hdr, "N")
+		for _, name := range []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"} {
+			if (hdr.Get(name) != "") != (name == tc.csp) {
+				t.Errorf("%+v: %s is %q", tc.rh, name, hdr.Get(name))
+			}
+		}
+		if got := hdr.Get("X-Frame-Options"); got != tc.framing {
+			t.Errorf("%+v: X-Frame-Options %q, wanted %q", tc.rh, got, tc.framing)
+		}
+		if hdr.Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%+v: no nosniff", tc.rh)
+		}
+	}
+}
+
+func TestCSPReportLimit(t *testing.T) {
+	b := testBlog(t)
+	report := `{"csp-report":{"document-uri":"https://example.com/` + strings.Repeat("x", 2*maxCSPLogLine) + `","violated-directive":"script-src"}}`
+	before := cspReportsDropped.Value()
+	for i := 0; i < cspLogBurst+5; i++ {
+		rec := httptest.NewRecorder()
+		b.cspReportHandler(rec, httptest.NewRequest("POST", cspReportPath, strings.NewReader(report)))
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("report %d: status %d", i, rec.Code)
+		}
+	}
+	if n := cspReportsDropped.Value() - before; n != 5 {
+		t.Fatalf("%d reports dropped, wanted 5", n)
+	}
+	if got := truncateLine("héllo", 2); got != "h..." {
+		t.Fatalf("truncated to %q", got)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	//set in the environment of a process started by a SIGUSR2 restart to the
+	//comma separated descriptors of the inherited listening sockets
+	listenFDEnv = `BLOGENGINE_LISTEN_FD`
+
+	//descriptor of the first inherited socket, after stdin, stdout and stderr
+	firstListenFD = 3
+
+	//a restarted process that lives this long got past its flag checks
+	handoffGrace = time.Second
+)
+
+// inheritedListener returns true if this process was started by a restart
+// and should take over its parent's listening sockets
+func inheritedListener() bool {
+	return os.Getenv(listenFDEnv) != ""
+}
+
+// listen returns a listening socket for each address, taking over those
+// handed down by a restarting parent in order and opening fresh ones for any
+// addresses beyond them, such as a newly configured HTTPS port
+func listen(addrs ...string) ([]net.Listener, error) {
+	var inherited []net.Listener
+	if v := os.Getenv(listenFDEnv); v != "" {
+		os.Unsetenv(listenFDEnv)
+		for _, s := range strings.Split(v, ",") {
+			fd, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("bad inherited listener %q", s)
+			}
+			f := os.NewFile(uintptr(fd), "listener")
+			l, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			inherited = append(inherited, l)
+		}
+	}
+	lsts := make([]net.Listener, 0, len(addrs))
+	for i, addr := range addrs {
+		if i < len(inherited) {
+			lsts = append(lsts, inherited[i])
+			continue
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range lsts {
+				l.Close()
+			}
+			return nil, err
+		}
+		lsts = append(lsts, l)
+	}
+	//sockets the new configuration has no use for
+	for i := len(lsts); i < len(inherited); i++ {
+		inherited[i].Close()
+	}
+	return lsts, nil
+}
+
+// handoff starts a new copy of the server that inherits the listening
+// sockets, it fails if the copy can not be started or exits straight away
+func handoff(lsts []net.Listener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	//duplicate the raw descriptors, handing the sockets over as *os.File
+	//would switch them to blocking mode under our own accept loops
+	files := []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()}
+	var fds []string
+	defer func() {
+		for _, fd := range files[firstListenFD:] {
+			syscall.Close(int(fd))
+		}
+	}()
+	for _, l := range lsts {
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			return errors.New("listener can not be handed off")
+		}
+		rc, err := tl.SyscallConn()
+		if err != nil {
+			return err
+		}
+		var dup int
+		var derr error
+		if err := rc.Control(func(fd uintptr) {
+			dup, derr = syscall.Dup(int(fd))
+		}); err != nil {
+			return err
+		} else if derr != nil {
+			return derr
+		}
+		fds = append(fds, strconv.Itoa(len(files)))
+		files = append(files, uintptr(dup))
+	}
+	attr := &syscall.ProcAttr{
+		Env:   append(os.Environ(), listenFDEnv+"="+strings.Join(fds, ",")),
+		Files: files,
+	}
+	pid, err := syscall.ForkExec(exe, os.Args, attr)
+	if err != nil {
+		return err
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		st, err := proc.Wait()
+		if err == nil {
+			err = errors.New(st.String())
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return fmt.Errorf("new process exited early: %v", err)
+	case <-time.After(handoffGrace):
+	}
+	return nil
+}
+
+// endpoint is a listening socket and what it serves, TLS is layered over the
+// raw socket so the socket itself can be handed off on restart
+type endpoint struct {
+	lst     net.Listener
+	handler http.Handler
+	tls     *tls.Config
+}
+
+// serve runs an HTTP server on every endpoint until SIGINT or SIGTERM, or
+// until SIGUSR2 hands the sockets to a new process, then stops accepting and
+// waits for in flight requests so no bolt write is cut off.  release is
+// called once the new process is running so it can take over the post DBs
+// without waiting for the drain.
+func serve(eps []endpoint, release func()) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+	return serveSignals(eps, sigs, release)
+}
+
+// serveSignals serves the endpoints until sigs asks it to stop
+func serveSignals(eps []endpoint, sigs <-chan os.Signal, release func()) error {
+	errs := make(chan error, len(eps))
+	var srvs []*http.Server
+	var lsts []net.Listener
+	for _, ep := range eps {
+		srv := &http.Server{
+			Handler:           ep.handler,
+			TLSConfig:         ep.tls,
+			ReadHeaderTimeout: *readTimeout,
+			ReadTimeout:       *readTimeout,
+			WriteTimeout:      *writeTimeout,
+			IdleTimeout:       *idleTimeout,
+		}
+		lst := ep.lst
+		if ep.tls != nil {
+			lst = tls.NewListener(lst, ep.tls)
+		}
+		go func() {
+			errs <- srv.Serve(lst)
+		}()
+		srvs = append(srvs, srv)
+		lsts = append(lsts, ep.lst)
+	}
+	for {
+		select {
+		case err := <-errs:
+			shutdown(srvs)
+			return err
+		case sig := <-sigs:
+			if sig == syscall.SIGUSR2 {
+				if err := handoff(lsts); err != nil {
+					fmt.Printf("Restart failed, still serving: %v\n", err)
+					continue
+				}
+				//requests still in flight here see the DBs closed, the
+				//new process is blocked on them until they are
+				release()
+				fmt.Printf("Restarted, draining requests\n")
+			} else {
+				fmt.Printf("Caught %v, draining requests\n", sig)
+			}
+			return shutdown(srvs)
+		}
+	}
+}
+
+// shutdown stops every server at once, waiting up to the shutdown timeout
+func shutdown(srvs []*http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	errs := make(chan error, len(srvs))
+	for _, srv := range srvs {
+		go func(srv *http.Server) {
+			errs <- srv.Shutdown(ctx)
+		}(srv)
+	}
+	var err error
+	for range srvs {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
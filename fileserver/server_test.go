@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain lets the test binary stand in for the new process of a restart
+func TestMain(m *testing.M) {
+	if inheritedListener() {
+		handoffChild()
+	}
+	os.Exit(m.Run())
+}
+
+// handoffChild takes over the inherited socket and answers one request
+func handoffChild() {
+	lsts, err := listen("127.0.0.1:0")
+	if err != nil {
+		os.Exit(1)
+	}
+	served := make(chan struct{}, 1)
+	go http.Serve(lsts[0], http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "child")
+		served <- struct{}{}
+	}))
+	select {
+	case <-served:
+		time.Sleep(100 * time.Millisecond)
+	case <-time.After(10 * time.Second):
+	}
+	os.Exit(0)
+}
+
+// testGet fetches url on a fresh connection, returning the body
+func testGet(url string) (string, error) {
+	cl := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	res, err := cl.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	return string(b), err
+}
+
+// inFlight serves a handler that blocks until wait returns, reporting the
+// start of each request on the returned channel
+func inFlight(wait func() string) (http.Handler, chan struct{}) {
+	started := make(chan struct{}, 1)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		io.WriteString(w, wait())
+	}), started
+}
+
+func TestServeShutdown(t *testing.T) {
+	lsts, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + lsts[0].Addr().String() + "/"
+	finish := make(chan struct{})
+	h, started := inFlight(func() string {
+		<-finish
+		return "done"
+	})
+	sigs := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- serveSignals([]endpoint{{lst: lsts[0], handler: h}}, sigs, func() {
+			t.Error("DBs released without a restart")
+		})
+	}()
+	res := make(chan string, 1)
+	go func() {
+		body, err := testGet(url)
+		if err != nil {
+			body = err.Error()
+		}
+		res <- body
+	}()
+	<-started
+	sigs <- syscall.SIGTERM
+
+	//new connections are refused while the request in flight drains
+	deadline := time.Now().Add(time.Second)
+	for {
+		c, err := net.Dial("tcp", lsts[0].Addr().String())
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("still accepting after SIGTERM")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("stopped before the request in flight finished")
+	default:
+	}
+	close(finish)
+	if body := <-res; body != "done" {
+		t.Fatalf("request in flight got %q", body)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	lsts, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + lsts[0].Addr().String() + "/"
+	released := make(chan struct{})
+	h, started := inFlight(func() string {
+		select {
+		case <-released:
+			return "released"
+		case <-time.After(5 * time.Second):
+			return "drained first"
+		}
+	})
+	sigs := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- serveSignals([]endpoint{{lst: lsts[0], handler: h}}, sigs, func() {
+			close(released)
+		})
+	}()
+	res := make(chan string, 1)
+	go func() {
+		body, err := testGet(url)
+		if err != nil {
+			body = err.Error()
+		}
+		res <- body
+	}()
+	<-started
+	sigs <- syscall.SIGUSR2
+
+	//the DBs are handed over while requests are still draining
+	if body := <-res; body != "released" {
+		t.Fatalf("request in flight got %q", body)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	//and the new process answers on the same socket
+	if body, err := testGet(url); err != nil || body != "child" {
+		t.Fatalf("after the handoff got %q: %v", body, err)
+	}
+}
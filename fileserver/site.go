@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// siteInfo is the site wide metadata handed to every template as .Site.  The
+// analytics snippet and footer come from the site operator and are trusted
+// as HTML.
+type siteInfo struct {
+	Name        string
+	Tagline     string
+	Description string
+	Author      string
+	BaseURL     string
+	Social      []socialLink
+	Analytics   template.HTML
+	Footer      template.HTML
+}
+
+type socialLink struct {
+	Name string
+	URL  string
+}
+
+// siteInfo builds the site metadata from the settings
+func (sc *siteConfig) siteInfo() (*siteInfo, error) {
+	si := &siteInfo{
+		Name:        sc.title,
+		Tagline:     sc.tagline,
+		Description: sc.description,
+		Author:      sc.author,
+		BaseURL:     strings.TrimRight(sc.baseURL, "/"),
+		Footer:      template.HTML(sc.footer),
+	}
+	var err error
+	if si.Social, err = parseSocialLinks(sc.social); err != nil {
+		return nil, err
+	}
+	if sc.analytics != "" {
+		b, err := ioutil.ReadFile(sc.analytics)
+		if err != nil {
+			return nil, fmt.Errorf("analytics snippet %s is not usable: %v", sc.analytics, err)
+		}
+		si.Analytics = template.HTML(b)
+	}
+	return si, nil
+}
+
+// parseSocialLinks parses a comma separated list of Name=URL links
+func parseSocialLinks(v string) ([]socialLink, error) {
+	var links []socialLink
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		eq := strings.Index(s, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("social link %q is not Name=URL", s)
+		}
+		sl := socialLink{
+			Name: strings.TrimSpace(s[:eq]),
+			URL:  strings.TrimSpace(s[eq+1:]),
+		}
+		if u, err := url.Parse(sl.URL); err != nil || !u.IsAbs() {
+			return nil, fmt.Errorf("social link %s URL %q must be an absolute URL", sl.Name, sl.URL)
+		}
+		links = append(links, sl)
+	}
+	return links, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sitemapDateFormat = "2006-01-02"
+)
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+func (b *blog) sitemapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		b.errorPage(w, r, http.StatusMethodNotAllowed)
+		return
+	}
+	base := b.siteBaseURL(r)
+	cd, err := b.docs.get(b.docKey("sitemap.xml"), func(time.Time) ([]byte, error) {
+		return b.renderSitemap(base)
+	})
+	if err != nil {
+		b.serverError(w, r, err)
+		return
+	}
+	serveDoc(w, r, cd, "application/xml; charset=utf-8")
+}
+
+// robotsHandler serves the configured robots.txt, or when none is configured
+// a permissive default that points crawlers at the sitemap
+func (b *blog) robotsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		b.errorPage(w, r, http.StatusMethodNotAllowed)
+		return
+	}
+	if b.robots != "" {
+		http.ServeFile(w, r, b.robots)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "User-agent: *\nAllow: /\n\nSitemap: %s/sitemap.xml\n", b.siteBaseURL(r))
+}
+
+// renderSitemap lists the index, archive, every published post, static page
+// and tag page.  Index, archive and tag pages carry the modification time of the
+// newest post they show.
+func (b *blog) renderSitemap(base string) ([]byte, error) {
+	items, err := b.publishedPosts("", 0)
+	if err != nil {
+		return nil, err
+	}
+	var us sitemapURLSet
+	var newest time.Time
+	tags := map[string]time.Time{}
+	for _, it := range items {
+		lm := it.bp.LastModified()
+		if lm.After(newest) {
+			newest = lm
+		}
+		for _, t := range it.bp.Tags {
+			t = strings.ToLower(t)
+			if lm.After(tags[t]) {
+				tags[t] = lm
+			}
+		}
+		us.URLs = append(us.URLs, sitemapURL{
+			Loc:     base + b.postPath(it.name, it.bp.Date),
+			LastMod: sitemapDate(lm),
+		})
+	}
+	us.URLs = append([]sitemapURL{
+		{Loc: base + "/", LastMod: sitemapDate(newest)},
+		{Loc: base + "/archive", LastMod: sitemapDate(newest)},
+	}, us.URLs...)
+
+	tagNames := make([]string, 0, len(tags))
+	for t := range tags {
+		tagNames = append(tagNames, t)
+	}
+	sort.Strings(tagNames)
+	for _, t := range tagNames {
+		us.URLs = append(us.URLs, sitemapURL{
+			Loc:     base + tagPath(t),
+			LastMod: sitemapDate(tags[t]),
+		})
+	}
+
+	pages, err := b.db.PageNames()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pages {
+		bp, err := b.db.GetPage(p)
+		if err != nil {
+			return nil, err
+		}
+		us.URLs = append(us.URLs, sitemapURL{
+			Loc:     base + pagePath(p),
+			LastMod: sitemapDate(bp.LastModified()),
+		})
+	}
+	return marshalXML(us)
+}
+
+func sitemapDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(sitemapDateFormat)
+}
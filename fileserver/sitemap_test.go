@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+func TestSitemap(t *testing.T) {
+	b := testBlog(t)
+	b.baseURL = "https://blog.example/"
+	addTestPost(t, b, "old", 0, blogpost.BlogPost{Tags: []string{"Go"}})
+	addTestPost(t, b, "new", 1, blogpost.BlogPost{Tags: []string{"go", "bolt"}})
+	if err := b.db.Add("draft", &blogpost.BlogPost{Title: "Draft", Status: blogpost.StatusDraft, Date: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.db.AddPage("about", &blogpost.BlogPost{Title: "About", Kind: blogpost.KindPage}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	b.sitemapHandler(rec, httptest.NewRequest("GET", "/sitemap.xml", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/xml") {
+		t.Fatalf("status %d type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var us sitemapURLSet
+	if err := xml.Unmarshal(rec.Body.Bytes(), &us); err != nil {
+		t.Fatal(err)
+	}
+	var locs []string
+	for _, u := range us.URLs {
+		locs = append(locs, u.Loc)
+		if _, err := time.Parse(sitemapDateFormat, u.LastMod); err != nil {
+			t.Errorf("%s: bad lastmod %q", u.Loc, u.LastMod)
+		}
+	}
+	//drafts are left out and tags are listed once whatever their case
+	want := []string{
+		"https://blog.example/",
+		"https://blog.example/archive",
+		"https://blog.example/new",
+		"https://blog.example/old",
+		"https://blog.example/tag/bolt",
+		"https://blog.example/tag/go",
+		"https://blog.example/about",
+	}
+	if !reflect.DeepEqual(locs, want) {
+		t.Fatalf("sitemap lists\n%q\nwanted\n%q", locs, want)
+	}
+
+	rec = httptest.NewRecorder()
+	b.robotsHandler(rec, httptest.NewRequest("GET", "/robots.txt", nil))
+	if !strings.Contains(rec.Body.String(), "Sitemap: https://blog.example/sitemap.xml") {
+		t.Fatalf("robots.txt does not point at the sitemap: %q", rec.Body.String())
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+const (
+	layoutDir    = `layouts`
+	partialDir   = `partials`
+	pageDir      = `pages`
+	templateExt  = `.template`
+	layoutName   = `layout`
+	contentName  = `content`
+	defaultTheme = `default`
+
+	pagePost    = `post`
+	pageIndex   = `index`
+	pageArchive = `archive`
+	pageTag     = `tag`
+	pageSearch  = `search`
+	pageError   = `error`
+	pagePage    = `page`
+)
+
+var (
+	errNoTemplate = errors.New("template not loaded")
+
+	requiredPages = []string{pagePost, pageIndex, pageArchive, pageTag, pageSearch, pageError, pagePage}
+)
+
+// templateSet holds every page template parsed against every layout.  The
+// partials and one layout are parsed first, then each page is parsed into a
+// clone of that so every page can define its own content block.
+type templateSet struct {
+	layouts map[string]map[string]*template.Template
+	modTime time.Time
+}
+
+// Lookup returns the template for a page in the named layout, falling back
+// to the default layout when the named one does not exist
+func (ts *templateSet) Lookup(layout, page string) (*template.Template, error) {
+	pages, ok := ts.layouts[layout]
+	if !ok {
+		pages = ts.layouts[defaultTheme]
+	}
+	t, ok := pages[page]
+	if !ok {
+		return nil, fmt.Errorf("no %s page template", page)
+	}
+	return t, nil
+}
+
+// execute renders the page named in pd with the layout the post asks for,
+// into a buffer first so a failed execution never sends half a page
+func (ts *templateSet) execute(w io.Writer, pd *pageData) error {
+	t, err := ts.Lookup(pd.Layout, pd.Page)
+	if err != nil {
+		return err
+	}
+	bb := bytes.NewBuffer(nil)
+	if err := t.Execute(bb, pd); err != nil {
+		return err
+	}
+	_, err = w.Write(bb.Bytes())
+	return err
+}
+
+// Layouts returns the names of the loaded layouts
+func (ts *templateSet) Layouts() []string {
+	var names []string
+	for n := range ts.layouts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// templateCache holds the parsed template set.  Changes on disk are picked up
+// by polling, and a new set only replaces the current one if every page
+// parses and renders sample data, so a broken edit never takes the site down.
+type templateCache struct {
+	mtx      sync.RWMutex
+	fsys     fs.FS
+	blog     *blog
+	set      *templateSet
+	version  uint64
+	lastSeen string
+}
+
+func newTemplateCache(fsys fs.FS, b *blog) (*templateCache, error) {
+	sig, modTime, err := templateSignature(fsys)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := loadTemplateSet(fsys, b)
+	if err != nil {
+		return nil, err
+	}
+	ts.modTime = modTime
+	return &templateCache{
+		fsys:     fsys,
+		blog:     b,
+		set:      ts,
+		version:  1,
+		lastSeen: sig,
+	}, nil
+}
+
+// Get returns the current template set and its version, the version is
+// bumped every time a new set is swapped in
+func (tc *templateCache) Get() (*templateSet, uint64) {
+	tc.mtx.RLock()
+	defer tc.mtx.RUnlock()
+	return tc.set, tc.version
+}
+
+// Reload swaps in the templates on disk if any of them changed since they
+// were last seen.  A set that fails to parse or execute is rejected and the
+// current one is kept.
+func (tc *templateCache) Reload() error {
+	sig, modTime, err := templateSignature(tc.fsys)
+	if err != nil {
+		return err
+	}
+	tc.mtx.RLock()
+	seen := tc.lastSeen
+	tc.mtx.RUnlock()
+	if sig == seen {
+		return nil
+	}
+	ts, err := loadTemplateSet(tc.fsys, tc.blog)
+
+	tc.mtx.Lock()
+	defer tc.mtx.Unlock()
+	//only report a broken template once per change
+	tc.lastSeen = sig
+	if err != nil {
+		return err
+	}
+	ts.modTime = modTime
+	tc.set = ts
+	tc.version++
+	return nil
+}
+
+// Watch polls the templates every interval until stop is closed
+func (tc *templateCache) Watch(interval time.Duration, stop chan struct{}) {
+	tckr := time.NewTicker(interval)
+	defer tckr.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tckr.C:
+			if err := tc.Reload(); err != nil {
+				fmt.Printf("Keeping previous templates, reload of %v failed: %v\n", tc.fsys, err)
+			}
+		}
+	}
+}
+
+// templateSignature summarizes the names, sizes and modification times of
+// every template file so any add, remove or edit changes it.  The newest
+// modification time is returned with it.
+func templateSignature(fsys fs.FS) (string, time.Time, error) {
+	var sb strings.Builder
+	var newest time.Time
+	for _, sub := range []string{layoutDir, partialDir, pageDir} {
+		files, err := templateFiles(fsys, sub)
+		if err != nil {
+			return "", newest, err
+		}
+		for _, f := range files {
+			fi, err := fs.Stat(fsys, f)
+			if err != nil {
+				return "", newest, err
+			}
+			if fi.ModTime().After(newest) {
+				newest = fi.ModTime()
+			}
+			fmt.Fprintf(&sb, "%s|%d|%d\n", f, fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	return sb.String(), newest, nil
+}
+
+// templateFiles lists the template files in a directory, a missing
+// directory has no templates
+func templateFiles(fsys fs.FS, dir string) ([]string, error) {
+	files, err := fs.Glob(fsys, path.Join(dir, "*"+templateExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func templateName(file string) string {
+	return strings.TrimSuffix(path.Base(file), templateExt)
+}
+
+// loadTemplateSet parses the layouts, partials and pages in fsys and makes
+// sure every page renders sample data in every layout
+func loadTemplateSet(fsys fs.FS, b *blog) (*templateSet, error) {
+	base := template.New("").Funcs(b.templateFuncs())
+	partials, err := templateFiles(fsys, partialDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range partials {
+		if err := parseTemplateFile(base.New(templateName(f)), fsys, f); err != nil {
+			return nil, err
+		}
+	}
+	layouts, err := templateFiles(fsys, layoutDir)
+	if err != nil {
+		return nil, err
+	}
+	pages := map[string]string{}
+	pageFiles, err := templateFiles(fsys, pageDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range pageFiles {
+		pages[templateName(f)] = f
+	}
+	for _, p := range requiredPages {
+		if _, ok := pages[p]; !ok {
+			return nil, fmt.Errorf("missing %s page template in %v", p, fsys)
+		}
+	}
+
+	ts := &templateSet{
+		layouts: map[string]map[string]*template.Template{},
+	}
+	for _, lf := range layouts {
+		lt, err := base.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if err := parseTemplateFile(lt.New(layoutName), fsys, lf); err != nil {
+			return nil, err
+		}
+		lpages := map[string]*template.Template{}
+		for name, pf := range pages {
+			pt, err := lt.Clone()
+			if err != nil {
+				return nil, err
+			}
+			if err := parseTemplateFile(pt.New(pageDir+"/"+name), fsys, pf); err != nil {
+				return nil, err
+			}
+			if pt.Lookup(contentName) == nil {
+				return nil, fmt.Errorf("%s does not define a %q template", pf, contentName)
+			}
+			t := pt.Lookup(layoutName)
+			if err := t.Execute(ioutil.Discard, b.samplePageData(name)); err != nil {
+				return nil, err
+			}
+			lpages[name] = t
+		}
+		ts.layouts[templateName(lf)] = lpages
+	}
+	if _, ok := ts.layouts[defaultTheme]; !ok {
+		return nil, fmt.Errorf("missing %s layout in %v", defaultTheme, fsys)
+	}
+	return ts, nil
+}
+
+func parseTemplateFile(t *template.Template, fsys fs.FS, file string) error {
+	b, err := fs.ReadFile(fsys, file)
+	if err != nil {
+		return err
+	}
+	if _, err := t.Parse(string(b)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// samplePageData fills every field a page might use so template errors show
+// up when the set is loaded rather than when a visitor hits the page
+func (b *blog) samplePageData(page string) *pageData {
+	now := time.Now()
+	sample := blogpost.BlogPost{
+		Title:   "Sample post",
+		Date:    now,
+		Content: "<p>Sample content</p>",
+		Summary: "Sample summary",
+		Tags:    []string{"sample"},
+		Status:  blogpost.StatusPublished,
+		Updated: now,
+	}
+	items := []postItem{{name: "sample", bp: &sample}}
+	pd := b.newPageData(page, sample)
+	pd.Name = "sample"
+	pd.Canonical = b.postPath("sample", now)
+	pd.Site = &siteInfo{
+		Name:        "Sample site",
+		Tagline:     "Sample tagline",
+		Description: "Sample description",
+		Author:      "Sample author",
+		BaseURL:     "https://example.com",
+		Social:      []socialLink{{Name: "Sample", URL: "https://example.com/sample"}},
+		Analytics:   "<!-- sample -->",
+		Footer:      "Sample footer",
+	}
+	pd.Menu = []menuLink{{Name: "sample", Title: "Sample", URL: pagePath("sample")}}
+	pd.Tag = "sample"
+	pd.Query = "sample"
+	pd.Code = 500
+	pd.Message = "Sample error"
+	pd.RequestID = "sample"
+	b.setPosts(pd, items)
+	pd.Results = []searchHit{{
+		Name:    "sample",
+		Title:   sample.Title,
+		URL:     b.postPath("sample", now),
+		Date:    now,
+		Snippet: "<mark>Sample</mark> content",
+	}}
+	return pd
+}
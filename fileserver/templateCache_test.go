@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTemplateDir copies the embedded theme to a directory that can be
+// edited
+func testTemplateDir(t *testing.T) string {
+	dir := t.TempDir()
+	if err := copyTree(defaultTemplates, ".", dir); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// editTemplate rewrites a template file, dating it later than before so the
+// change is seen whatever the file system's timestamp resolution
+func editTemplate(t *testing.T, dir, name, content string, mod time.Time) {
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTemplateReload(t *testing.T) {
+	b := testBlog(t)
+	dir := testTemplateDir(t)
+	tc, err := newTemplateCache(os.DirFS(dir), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	render := func() string {
+		ts, _ := tc.Get()
+		var bb bytes.Buffer
+		if err := ts.execute(&bb, b.samplePageData(pagePost)); err != nil {
+			t.Fatal(err)
+		}
+		return bb.String()
+	}
+	if err := tc.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ver := tc.Get(); ver != 1 {
+		t.Fatalf("unchanged templates reloaded to version %d", ver)
+	}
+
+	mod := time.Now().Add(time.Hour)
+	editTemplate(t, dir, "pages/post.template", `{{define "content"}}edited {{.Title}}{{end}}`, mod)
+	if err := tc.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ver := tc.Get(); ver != 2 || !strings.Contains(render(), "edited Sample post") {
+		t.Fatalf("edit not picked up, version %d", ver)
+	}
+
+	//sets that fail to parse or render are rejected, once, and the
+	//previous set stays in place
+	for i, bad := range []string{
+		`{{define "content"}}{{.Title}{{end}}`,
+		`{{define "content"}}{{.NoSuchField}}{{end}}`,
+		`{{define "other"}}no content block{{end}}`,
+	} {
+		mod = mod.Add(time.Minute)
+		editTemplate(t, dir, "pages/post.template", bad, mod)
+		if err := tc.Reload(); err == nil {
+			t.Fatalf("bad template %d accepted", i)
+		}
+		if err := tc.Reload(); err != nil {
+			t.Fatalf("bad template %d reported twice: %v", i, err)
+		}
+		if _, ver := tc.Get(); ver != 2 || !strings.Contains(render(), "edited Sample post") {
+			t.Fatalf("bad template %d replaced the set, version %d", i, ver)
+		}
+	}
+
+	//removing a required page is a change too
+	if err := os.Remove(filepath.Join(dir, "pages", "post.template")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Reload(); err == nil || !strings.Contains(err.Error(), "missing post page") {
+		t.Fatalf("missing page gave %v", err)
+	}
+}
+
+func TestTemplateLayouts(t *testing.T) {
+	b := testBlog(t)
+	if err := b.loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	ts, _ := b.templates.Get()
+	if got := strings.Join(ts.Layouts(), ","); got != "default,wide" {
+		t.Fatalf("layouts %s", got)
+	}
+	//an unknown layout falls back to the default one
+	def, err := ts.Lookup(defaultTheme, pagePost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lt, err := ts.Lookup("nope", pagePost); err != nil || lt != def {
+		t.Fatalf("unknown layout did not fall back: %v", err)
+	}
+	if wide, err := ts.Lookup("wide", pagePost); err != nil || wide == def {
+		t.Fatalf("wide layout not used: %v", err)
+	}
+	if _, err := ts.Lookup(defaultTheme, "nope"); err == nil {
+		t.Fatal("unknown page found")
+	}
+}
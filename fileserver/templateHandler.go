@@ -1,174 +1,236 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
-	"math/rand"
+	"html/template"
+	"io"
 	"net/http"
-	"os"
-	"path"
-	"text/template"
+	"strings"
+	"time"
 
 	"github.com/traetox/blogEngine/blogpost"
 )
 
-var (
-	mainTemplateFile string
-	db               *boltDB
-	lastRand         int64
-	lastRandReqAddr  string
-	passbytes        []byte
+const (
+	recentPosts = 5
+)
 
+var (
 	errNotAuthorized = errors.New("not authorized")
 	errNilDB         = errors.New("Nil DB")
 )
 
-func SetUpdatePassbytes(pass []byte) error {
-	if passbytes != nil {
-		return errors.New("Already set")
+func (b *blog) templateHandler(w http.ResponseWriter, r *http.Request) {
+	rc := NewResponseCapture(w)
+	r = b.withGeneration(r)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		rc.Header().Set("Allow", "GET, HEAD")
+		b.errorPage(rc, r, http.StatusMethodNotAllowed)
+	} else if b.serveFromCache(rc, r) {
+		//served straight from the rendered page cache
+	} else if r.URL.Path == "/" {
+		if err := b.getLatest(rc, r); err != nil {
+			b.serverError(rc, r, err)
+		}
+	} else {
+		if err := b.routeRequest(rc, r); err != nil {
+			b.serverError(rc, r, err)
+		}
 	}
-	passbytes = pass
-	return nil
+	//always log the request
+	b.logRequest(r, rc.Code())
 }
 
-func SetMainTemplateFile(file string) error {
-	fin, err := os.Open(file)
+func (b *blog) getLatest(rc *ResponseCapture, r *http.Request) error {
+	items, err := b.publishedPosts("", recentPosts+1)
 	if err != nil {
 		return err
 	}
-	if err := fin.Close(); err != nil {
-		return err
+	if len(items) == 0 {
+		return b.servePage(rc, r, b.newPageData(pageIndex, blogpost.BlogPost{
+			Title: "Nothing here yet",
+		}), time.Time{})
 	}
-	mainTemplateFile = file
-	return nil
+	pd := b.newPageData(pageIndex, *items[0].bp)
+	pd.Name = items[0].name
+	pd.Canonical = "/"
+	b.setPosts(pd, items[1:])
+	return b.servePage(rc, r, pd, b.listModTime(items))
 }
 
-func InitPostDB(boltDbFile string) error {
-	if db != nil {
-		return errors.New("DB already open")
-	}
-	tdb, err := NewBlogDB(boltDbFile)
-	if err != nil {
-		return err
-	}
-	db = tdb
-	return nil
+func (b *blog) getUpdate(rc *ResponseCapture, r *http.Request, name string, bp *blogpost.BlogPost) error {
+	pd := b.newPageData(pagePost, *bp)
+	pd.Name = name
+	pd.Canonical = b.postPath(name, bp.Date)
+	return b.servePage(rc, r, pd, bp.LastModified())
 }
 
-func ClosePostDB() error {
-	if db == nil {
-		return errors.New("DB already closed")
-	}
-	if err := db.Close(); err != nil {
+// renderTemplate executes the page template named in pd using the layout the
+// post asks for, or the default layout
+func (b *blog) renderTemplate(w io.Writer, pd *pageData) error {
+	if b.templates == nil {
+		return errNoTemplate
+	}
+	ts, _ := b.templates.Get()
+	return ts.execute(w, pd)
+}
+
+// servePage renders pd and serves it with a strong ETag over the page and
+// the template version, and a Last-Modified of the newer of modTime and the
+// templates.  ServeContent answers conditional requests with a 304.  A zero
+// modTime sends no Last-Modified.  Cacheable pages are stored in the rendered
+// page cache under the request path.
+func (b *blog) servePage(rc *ResponseCapture, r *http.Request, pd *pageData, modTime time.Time) error {
+	if b.templates == nil {
+		return errNoTemplate
+	}
+	ts, ver := b.templates.Get()
+	bb := bytes.NewBuffer(nil)
+	if err := ts.execute(bb, pd); err != nil {
 		return err
 	}
-	db = nil
+	hsh := sha256.New()
+	binary.Write(hsh, binary.LittleEndian, ver)
+	hsh.Write(bb.Bytes())
+	if !modTime.IsZero() && ts.modTime.After(modTime) {
+		modTime = ts.modTime
+	}
+	cp, cacheable := newCachedPage(pageKey{blog: b, path: r.URL.Path}, ver, pd)
+	if !cacheable {
+		cp = &cachedPage{}
+	}
+	cp.modTime = modTime
+	cp.etag = `"` + hex.EncodeToString(hsh.Sum(nil)[:16]) + `"`
+	cp.plain = bb.Bytes()
+	cp.nonced = bytes.Contains(cp.plain, []byte(noncePlaceholder))
+	gen, ok := requestGeneration(r)
+	cp.gen = gen
+	if ok && cacheable && rendered.enabled() {
+		if err := cp.compress(); err != nil {
+			return err
+		}
+		rendered.put(cp)
+	}
+	serveCachedPage(rc, r, cp)
 	return nil
 }
 
-func postUpdateHandler(w http.ResponseWriter, r *http.Request) {
-	rc := NewResponseCapture(w)
-	switch r.Method {
-	case "GET":
-		lastRandReqAddr = r.RemoteAddr
-		lastRand = rand.Int63()
-		if err := binary.Write(w, binary.LittleEndian, lastRand); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
-	case "POST":
-		if err := decodeNewUpdate(lastRand, lastRandReqAddr, r); err != nil {
-			rc.WriteHeader(http.StatusForbidden)
-		}
-		lastRand = 0
-	default:
-		rc.WriteHeader(http.StatusMethodNotAllowed)
-	}
-	//always log the request
-	logRequest(r, rc.Code())
+// listModTime returns when a list page last changed, the last change to the
+// post DB or, for posts updated before it was opened, the newest of them.
+// Deleting or unpublishing a post changes a list without leaving a newer post.
+func (b *blog) listModTime(items []postItem) time.Time {
+	mod := newestPost(items)
+	if _, gt := b.db.Generation(); gt.After(mod) {
+		mod = gt
+	}
+	return mod
 }
 
-func templateHandler(w http.ResponseWriter, r *http.Request) {
-	rc := NewResponseCapture(w)
-	if r.Method != "GET" {
-		rc.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-	if r.URL.Path == "/" {
-		if err := getLatest(rc); err != nil {
-			rc.WriteHeader(http.StatusInternalServerError)
-		}
-	} else {
-		_, req := path.Split(path.Clean(r.URL.Path))
-		if err := getUpdate(rc, req); err != nil {
-			rc.WriteHeader(http.StatusInternalServerError)
+// newestPost returns the latest modification time of a set of posts
+func newestPost(items []postItem) time.Time {
+	var newest time.Time
+	for _, it := range items {
+		if lm := it.bp.LastModified(); lm.After(newest) {
+			newest = lm
 		}
 	}
-	//always log the request
-	logRequest(r, rc.Code())
+	return newest
 }
 
-func getLatest(rc *ResponseCapture) error {
-	t, err := template.ParseFiles(mainTemplateFile)
-	if err != nil {
-		return err
+// siteBaseURL returns the configured base URL without a trailing slash,
+// falling back to the scheme and host of the request if none is configured
+func (b *blog) siteBaseURL(r *http.Request) string {
+	if b.baseURL != "" {
+		return strings.TrimRight(b.baseURL, "/")
 	}
-	bp, err := db.LatestPost()
-	if err != nil {
-		if err == errNoPosts {
-			bp = blogpost.BlogPost{
-				Title: "Nothing here yet",
-			}
-		} else {
-			return err
-		}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
 	}
-	if err := t.Execute(rc, bp); err != nil {
-		return err
-	}
-	return nil
+	return scheme + "://" + r.Host
 }
 
-func getUpdate(rc *ResponseCapture, req string) error {
-	t, err := template.ParseFiles(mainTemplateFile)
-	if err != nil {
-		return err
-	}
-	bp, err := db.Get(req)
-	if err != nil {
-		if err == errNotFound {
-			custom404(rc)
-			return nil
-		} else {
-			return err
-		}
-	}
-	if err := t.Execute(rc, bp); err != nil {
-		return err
-	}
-	return nil
+// pageData is handed to every page template.  The post being shown is
+// embedded so templates can use .Title and .Date directly, list pages fill in
+// Posts and Years instead.  Content shadows the raw post content with the
+// sanitized version, the only post HTML templates are allowed to see.
+type pageData struct {
+	blogpost.BlogPost
+	Content   template.HTML
+	Page      string
+	Name      string
+	Canonical string
+	Site      *siteInfo
+	Menu      []menuLink
+	TagLinks  []tagLink
+	Posts     []listPost
+	Years     []yearPosts
+	Tag       string
+	TagURL    string
+	Query     string
+	Results   []searchHit
+
+	Code      int
+	Message   string
+	RequestID string
+
+	//CSP nonce for inline scripts, filled in as the page is served
+	Nonce string
 }
 
-func decodeNewUpdate(seed int64, lastSeedAddr string, r *http.Request) error {
-	defer r.Body.Close()
-	if seed == 0 || lastSeedAddr == "" || passbytes == nil {
-		return errors.New("no seed set")
-	}
-	var bp blogpost.BlogPost
-	var name string
-	if err := blogpost.ReadBlogPost(r.Body, &bp, &name, seed, passbytes); err != nil {
-		return err
-	}
+type tagLink struct {
+	Name string
+	URL  string
+}
 
-	if err := db.Add(name, &bp); err != nil {
-		return err
-	}
-	return nil
+type listPost struct {
+	Name    string
+	URL     string
+	Title   string
+	Date    time.Time
+	Summary string
+	Tags    []string
+}
+
+type yearPosts struct {
+	Year  int
+	Posts []listPost
+}
+
+func (b *blog) newPageData(page string, bp blogpost.BlogPost) *pageData {
+	pd := &pageData{
+		BlogPost: bp,
+		Content:  sanitizeContent(bp.Content),
+		Page:     page,
+		Site:     b.site,
+		Menu:     b.siteMenu(),
+		Nonce:    noncePlaceholder,
+	}
+	for _, t := range bp.Tags {
+		pd.TagLinks = append(pd.TagLinks, tagLink{Name: t, URL: tagPath(t)})
+	}
+	return pd
 }
 
-func custom404(rc *ResponseCapture) {
-	rc.WriteHeader(http.StatusNotFound)
-	b := []byte(`<h1>Error 404<h1>
-		  <h4>There is nothing to see here</h4>
-		  <h5>No, really, I couldn't find anything.</h5>`)
-	rc.Write(b)
+// setPosts fills the flat post list and the same list grouped by year
+func (b *blog) setPosts(pd *pageData, items []postItem) {
+	for _, it := range items {
+		lp := listPost{
+			Name:    it.name,
+			URL:     b.postPath(it.name, it.bp.Date),
+			Title:   it.bp.Title,
+			Date:    it.bp.Date,
+			Summary: postSummary(it.bp),
+			Tags:    it.bp.Tags,
+		}
+		pd.Posts = append(pd.Posts, lp)
+		if n := len(pd.Years); n == 0 || pd.Years[n-1].Year != lp.Date.Year() {
+			pd.Years = append(pd.Years, yearPosts{Year: lp.Date.Year()})
+		}
+		pd.Years[len(pd.Years)-1].Posts = append(pd.Years[len(pd.Years)-1].Posts, lp)
+	}
 }
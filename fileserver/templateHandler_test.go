@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+func TestPagesHead(t *testing.T) {
+	b := testBlog(t)
+	if err := b.loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	addTestPost(t, b, "a", 0, blogpost.BlogPost{Tags: []string{"go"}})
+	for _, tc := range []struct {
+		h    http.HandlerFunc
+		path string
+	}{
+		{b.templateHandler, "/"},
+		{b.templateHandler, "/a"},
+		{b.archiveHandler, "/archive"},
+		{b.tagHandler, "/tag/go"},
+		{b.searchHandler, "/search?q=a"},
+	} {
+		rec := httptest.NewRecorder()
+		tc.h(rec, httptest.NewRequest("HEAD", tc.path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("HEAD %s: status %d", tc.path, rec.Code)
+		}
+		rec = httptest.NewRecorder()
+		tc.h(rec, httptest.NewRequest("POST", tc.path, nil))
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("POST %s: status %d allowing %q", tc.path, rec.Code, rec.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestIndexLastModified(t *testing.T) {
+	b := testBlog(t)
+	if err := b.loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	addTestPost(t, b, "old", 0, blogpost.BlogPost{})
+	addTestPost(t, b, "new", 1, blogpost.BlogPost{})
+	bp, err := b.db.Get("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp.Updated = bp.Date
+
+	//deleting the newest post leaves only older ones but still changes the index
+	if err := b.db.Delete("new"); err != nil {
+		t.Fatal(err)
+	}
+	_, changed := b.db.Generation()
+	for _, p := range []string{"/", "/archive"} {
+		rec := httptest.NewRecorder()
+		if p == "/" {
+			b.templateHandler(rec, httptest.NewRequest("GET", p, nil))
+		} else {
+			b.archiveHandler(rec, httptest.NewRequest("GET", p, nil))
+		}
+		lm, err := http.ParseTime(rec.Header().Get("Last-Modified"))
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		if lm.Before(changed.Truncate(time.Second)) {
+			t.Fatalf("%s last modified %v, before the delete at %v", p, lm, changed)
+		}
+	}
+}
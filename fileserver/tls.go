@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	//how often a handshake may check the certificate files for changes
+	certCheckInterval = 2 * time.Second
+)
+
+var (
+	errNoCertificate = errors.New("no certificate loaded")
+)
+
+// tlsEnabled returns true if the server should speak HTTPS
+func tlsEnabled() bool {
+	return *tlsCert != "" || *acmeDomains != ""
+}
+
+// certReloader serves a certificate and key pair from disk, reloading them
+// when either file changes so a renewed certificate is picked up without a
+// restart.  A pair that fails to load leaves the old one in use.
+type certReloader struct {
+	mtx      sync.Mutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+	checked  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cr.nlReload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// nlReload loads the pair if either file changed since it was last loaded
+func (cr *certReloader) nlReload() error {
+	cr.checked = time.Now()
+	cfi, err := os.Stat(cr.certFile)
+	if err != nil {
+		return err
+	}
+	kfi, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return err
+	}
+	if cr.cert != nil && cfi.ModTime().Equal(cr.certMod) && kfi.ModTime().Equal(cr.keyMod) {
+		return nil
+	}
+	c, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	if cr.cert != nil {
+		fmt.Printf("Reloaded TLS certificate %s\n", cr.certFile)
+	}
+	cr.cert = &c
+	cr.certMod = cfi.ModTime()
+	cr.keyMod = kfi.ModTime()
+	return nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mtx.Lock()
+	defer cr.mtx.Unlock()
+	if time.Since(cr.checked) > certCheckInterval {
+		if err := cr.nlReload(); err != nil {
+			fmt.Printf("Failed to reload TLS certificate, keeping the old one: %v\n", err)
+		}
+	}
+	if cr.cert == nil {
+		return nil, errNoCertificate
+	}
+	return cr.cert, nil
+}
+
+// newTLSConfig returns a TLS config with modern defaults: TLS 1.2 or newer,
+// forward secret AEAD suites only and HTTP/2
+func newTLSConfig(getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: getCert,
+	}
+}
+
+// newACMEManager returns a certificate manager that obtains and renews
+// certificates for the configured domains, answering both HTTP and TLS-ALPN
+// challenges.  A custom directory and CA bundle allow testing against a
+// local ACME server such as Pebble.  The hosts of every virtual host are
+// added to the configured domains.
+func newACMEManager() (*autocert.Manager, error) {
+	m := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(*acmeCache),
+		Email:  *acmeEmail,
+	}
+	domains := append(splitHosts(*acmeDomains), vhostNames()...)
+	m.HostPolicy = autocert.HostWhitelist(domains...)
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if *acmeCA != "" {
+		b, err := ioutil.ReadFile(*acmeCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", *acmeCA)
+		}
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	m.Client = &acme.Client{
+		DirectoryURL: *acmeDirectory,
+		HTTPClient:   &http.Client{Transport: tr},
+	}
+	return m, nil
+}
+
+// setupTLS returns the TLS config for the HTTPS listener and the handler
+// for the plain HTTP one, which redirects to HTTPS and answers ACME
+// challenges.  If redirects are turned off the site itself is served over
+// plain HTTP too.
+func setupTLS(site http.Handler) (*tls.Config, http.Handler, error) {
+	plain := site
+	if *httpsRedirect {
+		plain = http.HandlerFunc(redirectHTTPS)
+	}
+	if *acmeDomains == "" {
+		cr, err := newCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newTLSConfig(cr.GetCertificate), plain, nil
+	}
+	m, err := newACMEManager()
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := newTLSConfig(m.GetCertificate)
+	cfg.NextProtos = append(cfg.NextProtos, acme.ALPNProto)
+	return cfg, m.HTTPHandler(plain), nil
+}
+
+// redirectHTTPS permanently redirects a plain HTTP request to the same URL
+// on the HTTPS listener
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		http.Error(w, "missing Host header", http.StatusBadRequest)
+		return
+	}
+	if *tlsPort != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(*tlsPort))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	code := http.StatusMovedPermanently
+	if r.Method != "GET" && r.Method != "HEAD" {
+		//keep the method and body of pushes
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+}
+
+// hstsHandler adds a Strict-Transport-Security header to HTTPS responses
+func hstsHandler(h http.Handler) http.Handler {
+	if *hstsMaxAge <= 0 {
+		return h
+	}
+	hdr := fmt.Sprintf("max-age=%d", int64(hstsMaxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", hdr)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self signed certificate and key with the given
+// serial, dated mod
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64, mod time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+	writeTestCert(t, certFile, keyFile, 1, start)
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func() int64 {
+		c, err := cr.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+
+	//a renewed pair is only looked for once the check interval has passed
+	writeTestCert(t, certFile, keyFile, 2, start.Add(time.Minute))
+	if s := serial(); s != 1 {
+		t.Fatalf("reloaded inside the check interval, serial %d", s)
+	}
+	cr.checked = time.Time{}
+	if s := serial(); s != 2 {
+		t.Fatalf("renewed pair not loaded, serial %d", s)
+	}
+	//a pair that fails to load leaves the old one in use
+	if err := ioutil.WriteFile(keyFile, []byte("junk"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cr.checked = time.Time{}
+	if s := serial(); s != 2 {
+		t.Fatalf("bad pair replaced the old one, serial %d", s)
+	}
+
+	//and handshakes get whatever the reloader holds
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = newTLSConfig(cr.GetCertificate)
+	srv.StartTLS()
+	defer srv.Close()
+	cl := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{ServerName: "localhost", InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11},
+	}}
+	if _, err := cl.Get(srv.URL); err == nil {
+		t.Fatal("TLS 1.1 handshake accepted")
+	}
+	cl.Transport = &http.Transport{TLSClientConfig: &tls.Config{ServerName: "localhost", InsecureSkipVerify: true}}
+	res, err := cl.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if s := res.TLS.PeerCertificates[0].SerialNumber.Int64(); s != 2 {
+		t.Fatalf("served serial %d", s)
+	}
+}
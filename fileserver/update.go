@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+// challenges are the seeds handed out to update clients, one per address.
+// A push has to use the latest seed its address was given within the
+// challenge TTL, and a seed is good for a single push.
+type challenges struct {
+	mtx   sync.Mutex
+	seeds map[string]challenge
+}
+
+type challenge struct {
+	seed   int64
+	issued time.Time
+}
+
+func newChallenges() *challenges {
+	return &challenges{
+		seeds: map[string]challenge{},
+	}
+}
+
+// issue hands addr a fresh seed, replacing any it already had
+func (c *challenges) issue(addr string) int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := time.Now()
+	for a, ch := range c.seeds {
+		if now.Sub(ch.issued) > *challengeTTL {
+			delete(c.seeds, a)
+		}
+	}
+	var seed int64
+	for seed == 0 {
+		seed = rand.Int63()
+	}
+	c.seeds[addr] = challenge{seed: seed, issued: now}
+	return seed
+}
+
+// take returns the seed issued to addr and forgets it, false if there is
+// none or it has expired
+func (c *challenges) take(addr string) (int64, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	ch, ok := c.seeds[addr]
+	if !ok {
+		return 0, false
+	}
+	delete(c.seeds, addr)
+	if time.Since(ch.issued) > *challengeTTL {
+		return 0, false
+	}
+	return ch.seed, true
+}
+
+// updateStatus is the HTTP status each update error code is sent with
+var updateStatus = map[string]int{
+	blogpost.UpdateExpiredChallenge: http.StatusForbidden,
+	blogpost.UpdateAuthFailed:       http.StatusForbidden,
+	blogpost.UpdateInvalid:          http.StatusUnprocessableEntity,
+	blogpost.UpdateNameConflict:     http.StatusConflict,
+	blogpost.UpdateStorageFailed:    http.StatusInternalServerError,
+	blogpost.UpdateRateLimited:      http.StatusTooManyRequests,
+	blogpost.UpdateLockedOut:        http.StatusTooManyRequests,
+	blogpost.UpdateNotAllowed:       http.StatusForbidden,
+}
+
+func updateError(code, format string, args ...interface{}) *blogpost.UpdateError {
+	return &blogpost.UpdateError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// writeUpdateError answers a refused challenge or push with its JSON error
+func writeUpdateError(w http.ResponseWriter, ue *blogpost.UpdateError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if ue.RetryAfter > 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(ue.RetryAfter))
+	}
+	w.WriteHeader(updateStatus[ue.Code])
+	json.NewEncoder(w).Encode(ue)
+}
+
+// postUpdateHandler hands out a challenge seed on GET and takes a post pushed
+// with it on POST, both limited per address by the blog's update limiter.
+// Refusals carry a JSON error naming what went wrong.
+func (b *blog) postUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	rc := NewResponseCapture(w)
+	addr := remoteIP(r)
+	switch r.Method {
+	case "GET":
+		if ue := b.limits.admit(addr, false); ue != nil {
+			writeUpdateError(rc, ue)
+			break
+		}
+		if err := binary.Write(rc, binary.LittleEndian, b.challenges.issue(addr)); err != nil {
+			fmt.Printf("ERROR sending update challenge to %s: %v\n", addr, err)
+		}
+	case "POST":
+		if ue := b.limits.admit(addr, true); ue != nil {
+			writeUpdateError(rc, ue)
+			break
+		}
+		if ue := b.pushUpdate(addr, r); ue != nil {
+			writeUpdateError(rc, ue)
+		}
+	default:
+		rc.Header().Set("Allow", "GET, POST")
+		rc.WriteHeader(http.StatusMethodNotAllowed)
+	}
+	//always log the request
+	b.logRequest(r, rc.Code())
+}
+
+// pushUpdate authenticates, checks and stores a pushed post.  Every push
+// that does not decode counts as a failed attempt, malformed or not.
+func (b *blog) pushUpdate(addr string, r *http.Request) *blogpost.UpdateError {
+	defer r.Body.Close()
+	seed, ok := b.challenges.take(addr)
+	if !ok {
+		return updateError(blogpost.UpdateExpiredChallenge, "no current challenge for %s, fetch a new one", addr)
+	}
+	pc, ue := b.decodePush(seed, r)
+	if ue != nil {
+		b.limits.failed(addr, ue.Code)
+		return ue
+	}
+	b.limits.succeeded(addr)
+	if ue := b.checkUpdate(pc.Name, &pc.BP); ue != nil {
+		return ue
+	}
+	if err := b.storeUpdate(pc.Name, &pc.BP); err != nil {
+		fmt.Printf("ERROR storing update %q: %v\n", pc.Name, err)
+		return updateError(blogpost.UpdateStorageFailed, "the post DB failed to store %q", pc.Name)
+	}
+	return nil
+}
+
+// decodePush reads a push and decrypts it with the challenge seed
+func (b *blog) decodePush(seed int64, r *http.Request) (blogpost.PostContent, *blogpost.UpdateError) {
+	var pp blogpost.PostPush
+	if err := json.NewDecoder(r.Body).Decode(&pp); err != nil {
+		return blogpost.PostContent{}, updateError(blogpost.UpdateInvalid, "malformed push: %v", err)
+	}
+	if len(pp.IV) != aes.BlockSize || len(pp.Content) == 0 {
+		return blogpost.PostContent{}, updateError(blogpost.UpdateInvalid, "malformed push: %d byte IV and %d bytes of content", len(pp.IV), len(pp.Content))
+	}
+	pc, err := blogpost.DecodePostPush(&pp, seed, b.passbytes)
+	if err != nil {
+		return pc, updateError(blogpost.UpdateAuthFailed, "the push did not decrypt with the server's password")
+	}
+	return pc, nil
+}
+
+// checkUpdate validates an authenticated post and makes sure its name and
+// aliases do not belong to anything else
+func (b *blog) checkUpdate(name string, bp *blogpost.BlogPost) *blogpost.UpdateError {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return updateError(blogpost.UpdateInvalid, "bad name %q", name)
+	case strings.ContainsAny(name, "/?#%\\") || strings.IndexFunc(name, badNameRune) >= 0:
+		return updateError(blogpost.UpdateInvalid, "name %q can not contain spaces, control characters or any of / ? # %% \\", name)
+	case strings.TrimSpace(bp.Title) == "":
+		return updateError(blogpost.UpdateInvalid, "a title is required")
+	case bp.Status != "" && bp.Status != blogpost.StatusPublished && bp.Status != blogpost.StatusDraft:
+		return updateError(blogpost.UpdateInvalid, "unknown status %q", bp.Status)
+	case bp.Kind != "" && bp.Kind != blogpost.KindPost && bp.Kind != blogpost.KindPage:
+		return updateError(blogpost.UpdateInvalid, "unknown kind %q", bp.Kind)
+	case bp.IsPage() && (len(bp.Aliases) > 0 || bp.RenamedFrom != ""):
+		return updateError(blogpost.UpdateInvalid, "aliases and renames only apply to posts")
+	}
+	if bp.Layout != "" && b.templates != nil {
+		if ts, _ := b.templates.Get(); ts.layouts[bp.Layout] == nil {
+			return updateError(blogpost.UpdateInvalid, "no layout named %q, have %s", bp.Layout, strings.Join(ts.Layouts(), ", "))
+		}
+	}
+	if bp.IsPage() {
+		return nil
+	}
+	if _, err := b.db.GetPage(name); err == nil {
+		return updateError(blogpost.UpdateNameConflict, "a static page is already named %q", name)
+	}
+	for _, a := range bp.Aliases {
+		p := aliasPath(a)
+		if other := strings.TrimPrefix(p, "/"); other != name && other != bp.RenamedFrom {
+			if _, err := b.db.Get(other); err == nil {
+				return updateError(blogpost.UpdateNameConflict, "alias %q is the name of post %q", a, other)
+			}
+		}
+		if rd, err := b.db.Redirect(p); err == nil && rd.Post != "" && rd.Post != name && rd.Post != bp.RenamedFrom {
+			return updateError(blogpost.UpdateNameConflict, "alias %q already redirects to post %q", a, rd.Post)
+		}
+	}
+	return nil
+}
+
+func badNameRune(r rune) bool {
+	return r <= ' ' || r == 0x7f
+}
+
+// storeUpdate adds an authenticated post or page to the post DB
+func (b *blog) storeUpdate(name string, bp *blogpost.BlogPost) error {
+	if bp.IsPage() {
+		return b.db.AddPage(name, bp)
+	}
+	return b.db.Add(name, bp)
+}
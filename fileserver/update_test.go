@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/traetox/blogEngine/blogpost"
+)
+
+const testAddr = "192.0.2.1"
+
+// testChallenge fetches a challenge seed for testAddr
+func testChallenge(t *testing.T, b *blog) int64 {
+	r := httptest.NewRequest("GET", "/update", nil)
+	r.RemoteAddr = testAddr + ":1234"
+	rec := httptest.NewRecorder()
+	b.postUpdateHandler(rec, r)
+	var seed int64
+	if err := binary.Read(rec.Body, binary.LittleEndian, &seed); err != nil {
+		t.Fatalf("challenge status %d: %v", rec.Code, err)
+	}
+	return seed
+}
+
+// testPush posts body from testAddr, returning the status and any error
+func testPush(t *testing.T, b *blog, body []byte) (int, *blogpost.UpdateError) {
+	r := httptest.NewRequest("POST", "/update", bytes.NewReader(body))
+	r.RemoteAddr = testAddr + ":1234"
+	rec := httptest.NewRecorder()
+	b.postUpdateHandler(rec, r)
+	if rec.Code == http.StatusOK {
+		return rec.Code, nil
+	}
+	var ue blogpost.UpdateError
+	if err := json.Unmarshal(rec.Body.Bytes(), &ue); err != nil {
+		t.Fatalf("status %d with body %q: %v", rec.Code, rec.Body.String(), err)
+	}
+	return rec.Code, &ue
+}
+
+func TestPushMalformed(t *testing.T) {
+	b := testBlog(t)
+	b.passbytes = []byte("secret")
+	b.limits.rate = 0
+	b.limits.failLimit = 0
+	bp := blogpost.BlogPost{Title: "Hi", Content: "<p>hi</p>", Date: time.Now()}
+	valid := func() *blogpost.PostPush {
+		pp, err := blogpost.EncodeBlogPost(testChallenge(t, b), b.passbytes, bp, "hi")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pp
+	}
+	encode := func(pp *blogpost.PostPush) []byte {
+		bts, err := json.Marshal(pp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bts
+	}
+
+	for _, tc := range []struct {
+		name string
+		body func() []byte
+		code int
+		ue   string
+	}{
+		{"short IV", func() []byte {
+			testChallenge(t, b)
+			return []byte(`{"IV":"AAAA","Content":"AAAA"}`)
+		}, http.StatusUnprocessableEntity, blogpost.UpdateInvalid},
+		{"no content", func() []byte {
+			pp := valid()
+			pp.Content = nil
+			return encode(pp)
+		}, http.StatusUnprocessableEntity, blogpost.UpdateInvalid},
+		{"not JSON", func() []byte {
+			testChallenge(t, b)
+			return []byte(`{"IV":`)
+		}, http.StatusUnprocessableEntity, blogpost.UpdateInvalid},
+		{"truncated content", func() []byte {
+			pp := valid()
+			pp.Content = pp.Content[:len(pp.Content)/2]
+			return encode(pp)
+		}, http.StatusForbidden, blogpost.UpdateAuthFailed},
+		{"truncated body", func() []byte {
+			bts := encode(valid())
+			return bts[:len(bts)/2]
+		}, http.StatusUnprocessableEntity, blogpost.UpdateInvalid},
+		{"valid", func() []byte {
+			return encode(valid())
+		}, http.StatusOK, ""},
+	} {
+		code, ue := testPush(t, b, tc.body())
+		if code != tc.code || (ue == nil) != (tc.ue == "") || (ue != nil && ue.Code != tc.ue) {
+			t.Errorf("%s: status %d error %+v", tc.name, code, ue)
+		}
+	}
+	if got, err := b.db.Get("hi"); err != nil || !strings.Contains(got.Content, "hi") {
+		t.Fatalf("valid push not stored: %v", err)
+	}
+}
+
+func TestPushMalformedLockout(t *testing.T) {
+	b := testBlog(t)
+	b.passbytes = []byte("secret")
+	b.limits.rate = 0
+	b.limits.failLimit = 3
+	for i := 0; i < 3; i++ {
+		testChallenge(t, b)
+		if _, ue := testPush(t, b, []byte(`{"IV":"AAAA","Content":"AAAA"}`)); ue == nil || ue.Code != blogpost.UpdateInvalid {
+			t.Fatalf("push %d: %+v", i, ue)
+		}
+	}
+	//malformed pushes lock an address out just like bad passwords
+	if code, ue := testPush(t, b, []byte(`{}`)); code != http.StatusTooManyRequests || ue.Code != blogpost.UpdateLockedOut {
+		t.Fatalf("not locked out: %d %+v", code, ue)
+	}
+}
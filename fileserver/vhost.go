@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	vhostSection = `vhost`
+)
+
+var (
+	//sites configured by [vhost."host"] sections of the config file
+	vhosts []*siteConfig
+
+	//settings a vhost section takes and the site setting each one fills
+	vhostKeys = map[string]func(sc *siteConfig, v string){
+		"aliases":     func(sc *siteConfig, v string) { sc.hosts = append(sc.hosts, splitHosts(v)...) },
+		"root":        func(sc *siteConfig, v string) { sc.root = v },
+		"templates":   func(sc *siteConfig, v string) { sc.templateDir = v },
+		"postdb":      func(sc *siteConfig, v string) { sc.postDB = v },
+		"passfile":    func(sc *siteConfig, v string) { sc.passFile = v },
+		"log_file":    func(sc *siteConfig, v string) { sc.logFile = v },
+		"robots":      func(sc *siteConfig, v string) { sc.robots = v },
+		"redirects":   func(sc *siteConfig, v string) { sc.redirects = v },
+		"base_url":    func(sc *siteConfig, v string) { sc.baseURL = v },
+		"permalink":   func(sc *siteConfig, v string) { sc.permalink = v },
+		"title":       func(sc *siteConfig, v string) { sc.title = v },
+		"tagline":     func(sc *siteConfig, v string) { sc.tagline = v },
+		"description": func(sc *siteConfig, v string) { sc.description = v },
+		"author":      func(sc *siteConfig, v string) { sc.author = v },
+		"social":      func(sc *siteConfig, v string) { sc.social = v },
+		"analytics":   func(sc *siteConfig, v string) { sc.analytics = v },
+		"footer":      func(sc *siteConfig, v string) { sc.footer = v },
+	}
+)
+
+// siteConfig is the configuration of a single blog.  The default site has
+// no name or hosts and answers for any host the virtual hosts do not claim.
+type siteConfig struct {
+	name        string
+	hosts       []string
+	root        string
+	templateDir string
+	postDB      string
+	passFile    string
+	logFile     string
+	robots      string
+	redirects   string
+	baseURL     string
+	permalink   string
+	title       string
+	tagline     string
+	description string
+	author      string
+	social      string
+	analytics   string
+	footer      string
+}
+
+// defaultSite returns the site configured by the top level settings
+func defaultSite() *siteConfig {
+	return &siteConfig{
+		root:        *root,
+		templateDir: *templateDir,
+		postDB:      *postDB,
+		passFile:    *passFile,
+		logFile:     *logFile,
+		robots:      *robotsFile,
+		redirects:   *redirectsFile,
+		baseURL:     *baseURL,
+		permalink:   *permalinkFmt,
+		title:       *siteTitle,
+		tagline:     *siteTagline,
+		description: *siteDesc,
+		author:      *siteAuthor,
+		social:      *siteSocial,
+		analytics:   *siteAnalytics,
+		footer:      *siteFooter,
+	}
+}
+
+// siteConfigs returns the default site followed by every virtual host
+func siteConfigs() []*siteConfig {
+	return append([]*siteConfig{defaultSite()}, vhosts...)
+}
+
+func (sc *siteConfig) String() string {
+	if sc.name == "" {
+		return "default site"
+	}
+	return "vhost " + sc.name
+}
+
+// newVhosts builds the virtual hosts from the values of their config file
+// sections.  Anything a section leaves out is taken from the default site,
+// apart from the post DB, base URL and redirects which belong to one site,
+// and the password and log files so sites never share update credentials or
+// mix their access logs without saying so.
+func newVhosts(vals []configValue) []*siteConfig {
+	var scs []*siteConfig
+	byName := map[string]*siteConfig{}
+	for _, v := range vals {
+		if v.section != vhostSection {
+			continue
+		}
+		sc, ok := byName[v.name]
+		if !ok {
+			sc = defaultSite()
+			sc.name = v.name
+			sc.hosts = []string{v.name}
+			sc.postDB = ""
+			sc.baseURL = ""
+			sc.redirects = ""
+			sc.passFile = ""
+			sc.logFile = ""
+			byName[v.name] = sc
+			scs = append(scs, sc)
+		}
+		vhostKeys[v.setting](sc, v.value)
+	}
+	return scs
+}
+
+// splitHosts splits a comma separated list of host names
+func splitHosts(v string) []string {
+	var hosts []string
+	for _, h := range strings.Split(v, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, strings.ToLower(h))
+		}
+	}
+	return hosts
+}
+
+// vhostNames returns every host name claimed by a virtual host
+func vhostNames() []string {
+	var hosts []string
+	for _, sc := range vhosts {
+		hosts = append(hosts, sc.hosts...)
+	}
+	return hosts
+}
+
+// validate checks the settings of one site for the command being run
+func (sc *siteConfig) validate() []string {
+	var ce []string
+	//both directories are optional, the embedded defaults fill in for them
+	for _, d := range []struct{ what, dir string }{{"root", sc.root}, {"templates", sc.templateDir}} {
+		if d.dir == "" {
+			continue
+		} else if fi, err := os.Stat(d.dir); err != nil {
+			ce = append(ce, fmt.Sprintf("%s %s is not usable: %v", d.what, d.dir, err))
+		} else if !fi.IsDir() {
+			ce = append(ce, fmt.Sprintf("%s %s is not a directory", d.what, d.dir))
+		}
+	}
+	if sc.postDB == "" {
+		ce = append(ce, "I need a post DB path")
+	}
+	if _, err := parsePermalink(sc.permalink); err != nil {
+		ce = append(ce, err.Error())
+	}
+	if _, err := sc.siteInfo(); err != nil {
+		ce = append(ce, err.Error())
+	}
+	if command == "" {
+		if sc.passFile == "" {
+			ce = append(ce, "I need a password file")
+		} else if _, err := os.Stat(sc.passFile); err != nil {
+			ce = append(ce, fmt.Sprintf("password file %s is not usable: %v", sc.passFile, err))
+		}
+		if sc.logFile == "" {
+			ce = append(ce, "I need a log file")
+		} else if fi, err := os.Stat(filepath.Dir(sc.logFile)); err != nil || !fi.IsDir() {
+			ce = append(ce, fmt.Sprintf("log file directory %s does not exist", filepath.Dir(sc.logFile)))
+		}
+	}
+	if sc.baseURL != "" {
+		u, err := url.Parse(sc.baseURL)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			ce = append(ce, fmt.Sprintf("base URL %q must be an absolute URL", sc.baseURL))
+		}
+	}
+	if sc.robots != "" {
+		if _, err := os.Stat(sc.robots); err != nil {
+			ce = append(ce, fmt.Sprintf("robots file %s is not usable: %v", sc.robots, err))
+		}
+	}
+	if sc.redirects != "" {
+		if _, err := os.Stat(sc.redirects); err != nil {
+			ce = append(ce, fmt.Sprintf("redirects file %s is not usable: %v", sc.redirects, err))
+		}
+	}
+	for _, h := range sc.hosts {
+		if strings.ContainsAny(h, ":/ ") {
+			ce = append(ce, fmt.Sprintf("host %q must be a bare host name without a port", h))
+		}
+	}
+	return ce
+}
+
+// validateSites checks every site and that no two of them share a post DB,
+// which only one of them could open, or a host name
+func validateSites() []string {
+	var ce []string
+	dbs := map[string]*siteConfig{}
+	hosts := map[string]*siteConfig{}
+	for _, sc := range siteConfigs() {
+		for _, e := range sc.validate() {
+			if sc.name != "" {
+				e = fmt.Sprintf("%v: %s", sc, e)
+			}
+			ce = append(ce, e)
+		}
+		if sc.postDB != "" {
+			if prev, ok := dbs[filepath.Clean(sc.postDB)]; ok {
+				ce = append(ce, fmt.Sprintf("%v and %v share the post DB %s", prev, sc, sc.postDB))
+			}
+			dbs[filepath.Clean(sc.postDB)] = sc
+		}
+		for _, h := range sc.hosts {
+			if prev, ok := hosts[h]; ok && prev != sc {
+				ce = append(ce, fmt.Sprintf("%v and %v both claim host %s", prev, sc, h))
+			}
+			hosts[h] = sc
+		}
+	}
+	return ce
+}
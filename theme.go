@@ -0,0 +1,15 @@
+// Package blogEngine carries the default theme, the templates and webroot
+// assets the fileserver falls back to for anything not found on disk.
+package blogEngine
+
+import (
+	"embed"
+)
+
+var (
+	//go:embed templates
+	Templates embed.FS
+
+	//go:embed webroot
+	Webroot embed.FS
+)